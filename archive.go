@@ -0,0 +1,643 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020 Don Owens <don@regexguy.com>.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+//   this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package fileutil
+
+import (
+    // Built-in/core modules.
+    tar "archive/tar"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+)
+
+// An entry in an archive opened with `OpenArchive()`. Reading from the entry
+// returns its contents. If the entry's name ends in a supported compression
+// suffix, e.g., "logs/app.log.gz", its contents are decompressed, unless the
+// archive was opened with `ArchiveOptions.Raw` set.
+type ArchiveEntry interface {
+    // Name() returns the name of the archive and the path of the entry,
+    // separated by "!/", e.g., "archive.tar.gz!/path/inside".
+    NameReadCloser
+
+    // The path of the entry inside the archive, e.g., "path/inside".
+    Path() string
+
+    // Information about the entry as recorded in the archive. The size is
+    // that of the stored data, before any decompression.
+    FileInfo() os.FileInfo
+
+    // The target of a symbolic or hard link. Empty for other entries. A hard
+    // link is reported as a regular file with a link target.
+    LinkTarget() string
+
+    // The name of the compression format of the entry's contents, e.g.,
+    // "gzip", or the empty string if they aren't compressed or aren't being
+    // decompressed.
+    Format() string
+}
+
+// Reads the entries of a tar or zip archive in turn.
+type ArchiveReader struct {
+    name string
+    opts ArchiveOptions
+    next_func func() (*archive_entry, error)
+    close_func CloseFunc
+    entry *archive_entry
+}
+
+// Opens a tar or zip archive for reading. Files ending in ".zip" are read as
+// zip archives, and anything else as tar. If the file name ends in a
+// supported compression suffix, e.g., "logs.tar.gz" or "logs.tgz", the
+// archive is decompressed as with `OpenFile()`. Zip archives need random
+// access, so they must be uncompressed files rather than the standard input.
+//
+// Call `Next()` to iterate over the entries, and `Close()` on the returned
+// ArchiveReader when done.
+func OpenArchive(archive string) (*ArchiveReader, error) {
+    return OpenArchiveWithOptions(archive, ArchiveOptions{})
+}
+
+// Options for reading archives with `OpenArchiveWithOptions()`. The zero
+// value gives the same behavior as `OpenArchive()`.
+type ArchiveOptions struct {
+    // Decompression limits and HTTP settings, applied to the archive itself
+    // and to entries decompressed because of their suffix. The compression
+    // built into zip entries isn't limited by these, but archive/zip fails
+    // reads that go past the size recorded for the entry, as reported by
+    // `ArchiveEntry.FileInfo()`.
+    OpenOptions
+
+    // Return the contents of entries as stored in the archive, without
+    // decompressing entries whose names end in a compression suffix. The
+    // archive itself is still decompressed.
+    Raw bool
+}
+
+// Like `OpenArchive()`, with the options in `opts`.
+func OpenArchiveWithOptions(
+    archive string,
+    opts ArchiveOptions,
+) (*ArchiveReader, error) {
+    if is_zip_path(archive) {
+        return open_zip_archive(archive, opts)
+    }
+
+    return open_tar_archive(archive, opts)
+}
+
+func open_tar_archive(
+    archive string,
+    opts ArchiveOptions,
+) (*ArchiveReader, error) {
+    in, err := open_file(context.Background(), archive, &opts.OpenOptions)
+    if err != nil {
+        return nil, err
+    }
+
+    a := &ArchiveReader{name: in.Name(), opts: opts, close_func: in.Close}
+    tr := tar.NewReader(in)
+
+    a.next_func = func() (*archive_entry, error) {
+        hdr, err := tr.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        entry := &archive_entry{
+            name: archive_entry_name(a.name, hdr.Name),
+            path: hdr.Name,
+            info: hdr.FileInfo(),
+            link_target: hdr.Linkname,
+        }
+        entry.set_reader(tr, nil, &a.opts)
+
+        return entry, nil
+    }
+
+    return a, nil
+}
+
+// Returns the name of the archive.
+func (a *ArchiveReader) Name() string {
+    return a.name
+}
+
+// Advances to the next entry in the archive and returns it. Returns io.EOF
+// at the end of the archive. The previous entry is closed, and can no longer
+// be read.
+func (a *ArchiveReader) Next() (ArchiveEntry, error) {
+    if a.entry != nil {
+        a.entry.Close()
+        a.entry = nil
+    }
+
+    entry, err := a.next_func()
+    if err != nil {
+        return nil, err
+    }
+    a.entry = entry
+
+    return entry, nil
+}
+
+// Closes the current entry and the archive.
+func (a *ArchiveReader) Close() error {
+    if a.entry != nil {
+        a.entry.Close()
+        a.entry = nil
+    }
+
+    return a.close_func()
+}
+
+func archive_entry_name(archive, path string) string {
+    return fmt.Sprintf("%s!/%s", archive, strings.TrimPrefix(path, "/"))
+}
+
+type archive_entry struct {
+    name string
+    path string
+    info os.FileInfo
+    link_target string
+    format string
+    rc io.ReadCloser
+    closed bool
+}
+
+// Sets the entry's contents to be read from r, adding a decompression layer
+// if the entry is a regular file with a supported compression suffix.
+// close_func, if not nil, is called when the entry is closed. No layer is
+// added if opts.Raw is set. The decompression layer is added on the first
+// read, so an entry that can't be decompressed gives an error from `Read()`
+// instead of stopping iteration over the rest of the archive.
+func (e *archive_entry) set_reader(
+    r io.Reader,
+    close_func CloseFunc,
+    opts *ArchiveOptions,
+) {
+    e.rc = ReadCloserFromReader(r, close_func)
+    if opts.Raw || !e.info.Mode().IsRegular() || e.link_target != "" {
+        return
+    }
+
+    c := lookup_codec(file_suffix(e.path))
+    if c == nil {
+        return
+    }
+
+    e.rc = &lazy_codec_reader{name: e.name, r: r, c: c,
+        opts: &opts.OpenOptions, close_func: close_func}
+    e.format = c.name
+}
+
+// A decompression layer that is added when first read from.
+type lazy_codec_reader struct {
+    name string
+    r io.Reader
+    c *codec
+    opts *OpenOptions
+    close_func CloseFunc
+    rc io.ReadCloser
+    err error
+}
+
+func (l *lazy_codec_reader) Read(p []byte) (int, error) {
+    if l.rc == nil && l.err == nil {
+        rc, err := add_codec_reader(context.Background(), l.r, l.c, l.opts)
+        if err != nil {
+            l.err = fmt.Errorf("couldn't add decompression layer for %s: %w",
+                l.name, err)
+        } else {
+            l.rc = rc
+        }
+    }
+    if l.err != nil {
+        return 0, l.err
+    }
+
+    return l.rc.Read(p)
+}
+
+func (l *lazy_codec_reader) Close() error {
+    var err error
+    if l.rc != nil {
+        err = l.rc.Close()
+    }
+    if l.close_func != nil {
+        if close_err := l.close_func(); err == nil {
+            err = close_err
+        }
+    }
+
+    return err
+}
+
+func (e *archive_entry) Name() string {
+    return e.name
+}
+
+func (e *archive_entry) Path() string {
+    return e.path
+}
+
+func (e *archive_entry) FileInfo() os.FileInfo {
+    return e.info
+}
+
+func (e *archive_entry) LinkTarget() string {
+    return e.link_target
+}
+
+func (e *archive_entry) Format() string {
+    return e.format
+}
+
+func (e *archive_entry) Read(p []byte) (int, error) {
+    if e.closed {
+        return 0, os.ErrClosed
+    }
+    return e.rc.Read(p)
+}
+
+// Shuts down any decompression layer. The archive itself stays open.
+func (e *archive_entry) Close() error {
+    if e.closed {
+        return nil
+    }
+    e.closed = true
+
+    return e.rc.Close()
+}
+
+// Returned when an entry is added to an archive while another entry written
+// directly to the archive is still open.
+var Err_EntryOpen = errors.New("previous archive entry is still open")
+
+// Writes a tar or zip archive one entry at a time. The methods of an
+// ArchiveWriter, and the `Close()` methods of its entries, may be called from
+// several goroutines, e.g., to fill entries from `CreateEntry()` in parallel.
+// Each entry must only be written to by one goroutine at a time, and not
+// while the archive is being closed.
+type ArchiveWriter struct {
+    name string
+    out NameWriteCloser
+    format archive_format
+
+    // Guards the fields below and the entries written by `format`.
+    mu sync.Mutex
+    zip_method uint16
+    entry *archive_file_writer
+    spools map[*archive_spool_writer]bool
+}
+
+// Writes entries to an archive in a particular format. Entries are described
+// by a tar header whatever the format.
+type archive_format interface {
+    // Starts an entry and returns a writer for its data. The zip method is
+    // ignored by other formats.
+    begin_entry(hdr *tar.Header, zip_method uint16) (io.Writer, error)
+
+    // Finishes the current entry.
+    end_entry() error
+
+    // Finishes the archive, without closing the underlying file.
+    close() error
+}
+
+// Creates a tar or zip archive for writing. Files ending in ".zip" are
+// written as zip archives, and anything else as tar. The file is created with
+// `CreateFileBuffered()`, so if the file name ends in a supported compression
+// suffix, e.g., "reports.tar.gz" or "reports.tgz", the archive is compressed
+// in that format. Zip archives can't be compressed this way, as
+// `OpenArchive()` couldn't read them.
+//
+// Add entries with `AddFile()` or `CreateEntry()`, and be sure to call
+// `Close()` on the returned ArchiveWriter to finish the archive.
+func CreateArchive(archive string) (*ArchiveWriter, error) {
+    is_zip := is_zip_path(archive)
+    if is_zip && ParsePath(archive).Compression != "" {
+        return nil, fmt.Errorf(
+            "couldn't create zip archive %s: compressed zip archives can't " +
+                "be read back: %w", archive, Err_NotSupported)
+    }
+
+    out, err := CreateFileBuffered(archive, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    a := &ArchiveWriter{name: out.Name(), out: out}
+    if is_zip {
+        a.format = new_zip_format(out)
+        a.zip_method = ZipDeflate
+    } else {
+        a.format = &tar_format{tw: tar.NewWriter(out)}
+    }
+
+    return a, nil
+}
+
+// Returns the name of the archive.
+func (a *ArchiveWriter) Name() string {
+    return a.name
+}
+
+// Adds an entry named `path` to the archive, taking its mode, modification
+// time, and size from `info`, e.g., as returned by `os.Stat()`. Data written
+// to the returned NameWriteCloser goes straight into the archive, so exactly
+// `info.Size()` bytes must be written before calling `Close()`, and no other
+// entry may be added until then. Directories take no data. Other file types
+// aren't supported.
+func (a *ArchiveWriter) AddFile(path string,
+    info os.FileInfo) (NameWriteCloser, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if a.entry != nil {
+        return nil, Err_EntryOpen
+    }
+
+    if !info.Mode().IsRegular() && !info.IsDir() {
+        return nil, fmt.Errorf("couldn't add %s to archive: %w", path,
+            Err_NotSupported)
+    }
+
+    hdr, err := tar.FileInfoHeader(info, "")
+    if err != nil {
+        return nil, fmt.Errorf("couldn't add %s to archive: %w", path, err)
+    }
+    hdr.Name = path
+    if info.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+        hdr.Name += "/"
+    }
+
+    data, err := a.format.begin_entry(hdr, a.zip_method)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't add %s to archive: %w", path, err)
+    }
+
+    w := &archive_file_writer{
+        name: archive_entry_name(a.name, hdr.Name),
+        archive: a,
+        data: data,
+        size: hdr.Size,
+    }
+    a.entry = w
+
+    return w, nil
+}
+
+// Adds an entry named `path` to the archive, with data of unknown size. Data
+// written to the returned NameWriteCloser is spooled to a temporary file and
+// copied into the archive when it is closed. Several such entries may be open
+// at once; they are added to the archive in the order they are closed. Any
+// still open when the archive is closed are discarded, along with their
+// spool files. While an entry from `AddFile()` is open, closing one returns
+// Err_EntryOpen, and it can be closed again once that entry is finished. If
+// `mtime` is the zero time, the time the entry is closed is used.
+func (a *ArchiveWriter) CreateEntry(path string, mode os.FileMode,
+    mtime time.Time) (NameWriteCloser, error) {
+    spool, err := os.CreateTemp("", "fileutil_spool_*")
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create spool file for %s: %w", path,
+            err)
+    }
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    w := &archive_spool_writer{
+        name: archive_entry_name(a.name, path),
+        path: path,
+        mode: mode,
+        mtime: mtime,
+        zip_method: a.zip_method,
+        archive: a,
+        spool: spool,
+    }
+    if a.spools == nil {
+        a.spools = map[*archive_spool_writer]bool{}
+    }
+    a.spools[w] = true
+
+    return w, nil
+}
+
+// Closes any open entry, finishes the archive, and closes the file.
+func (a *ArchiveWriter) Close() error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    var errs []error
+    if a.entry != nil {
+        if err := a.entry.close(); err != nil {
+            errs = append(errs, err)
+        }
+    }
+
+    for w := range a.spools {
+        w.discard()
+    }
+
+    if err := a.format.close(); err != nil {
+        errs = append(errs, fmt.Errorf("couldn't finish archive %s: %w",
+            a.name, err))
+    }
+
+    if err := a.out.Close(); err != nil {
+        errs = append(errs, err)
+    }
+
+    return errors.Join(errs...)
+}
+
+type tar_format struct {
+    tw *tar.Writer
+}
+
+func (f *tar_format) begin_entry(
+    hdr *tar.Header,
+    zip_method uint16,
+) (io.Writer, error) {
+    if err := f.tw.WriteHeader(hdr); err != nil {
+        return nil, err
+    }
+
+    return f.tw, nil
+}
+
+func (f *tar_format) end_entry() error {
+    return f.tw.Flush()
+}
+
+func (f *tar_format) close() error {
+    return f.tw.Close()
+}
+
+type archive_file_writer struct {
+    name string
+    archive *ArchiveWriter
+    data io.Writer
+    size int64
+    written int64
+    closed bool
+}
+
+func (w *archive_file_writer) Name() string {
+    return w.name
+}
+
+func (w *archive_file_writer) Write(p []byte) (int, error) {
+    if w.closed {
+        return 0, os.ErrClosed
+    }
+
+    n, err := w.data.Write(p)
+    w.written += int64(n)
+
+    return n, err
+}
+
+func (w *archive_file_writer) Close() error {
+    w.archive.mu.Lock()
+    defer w.archive.mu.Unlock()
+
+    return w.close()
+}
+
+// Finishes the entry. The archive's lock must be held.
+func (w *archive_file_writer) close() error {
+    if w.closed {
+        return nil
+    }
+    w.closed = true
+    w.archive.entry = nil
+
+    if w.written != w.size {
+        return fmt.Errorf("couldn't finish %s: wrote %d of %d bytes", w.name,
+            w.written, w.size)
+    }
+
+    return w.archive.format.end_entry()
+}
+
+type archive_spool_writer struct {
+    name string
+    path string
+    mode os.FileMode
+    mtime time.Time
+    zip_method uint16
+    archive *ArchiveWriter
+    spool *os.File
+    closed bool
+}
+
+func (w *archive_spool_writer) Name() string {
+    return w.name
+}
+
+func (w *archive_spool_writer) Write(p []byte) (int, error) {
+    if w.closed {
+        return 0, os.ErrClosed
+    }
+
+    return w.spool.Write(p)
+}
+
+// Closes and removes the spool file without adding the entry. The archive's
+// lock must be held.
+func (w *archive_spool_writer) discard() {
+    if w.closed {
+        return
+    }
+    w.closed = true
+    delete(w.archive.spools, w)
+
+    w.spool.Close()
+    os.Remove(w.spool.Name())
+}
+
+// Copies the spooled data into the archive and removes the spool file.
+func (w *archive_spool_writer) Close() error {
+    w.archive.mu.Lock()
+    defer w.archive.mu.Unlock()
+
+    if w.closed {
+        return nil
+    }
+    if w.archive.entry != nil {
+        return Err_EntryOpen
+    }
+    w.closed = true
+    delete(w.archive.spools, w)
+
+    defer os.Remove(w.spool.Name())
+    defer w.spool.Close()
+
+    size, err := w.spool.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return fmt.Errorf("couldn't get size of spool file for %s: %w",
+            w.name, err)
+    }
+    if _, err = w.spool.Seek(0, io.SeekStart); err != nil {
+        return fmt.Errorf("couldn't rewind spool file for %s: %w", w.name,
+            err)
+    }
+
+    mtime := w.mtime
+    if mtime.IsZero() {
+        mtime = time.Now()
+    }
+
+    hdr := &tar.Header{
+        Typeflag: tar.TypeReg,
+        Name: w.path,
+        Mode: int64(w.mode.Perm()),
+        ModTime: mtime,
+        Size: size,
+    }
+    data, err := w.archive.format.begin_entry(hdr, w.zip_method)
+    if err != nil {
+        return fmt.Errorf("couldn't add %s to archive: %w", w.path, err)
+    }
+
+    if _, err = io.Copy(data, w.spool); err != nil {
+        return fmt.Errorf("couldn't copy %s into archive: %w", w.path, err)
+    }
+
+    return w.archive.format.end_entry()
+}
@@ -0,0 +1,551 @@
+package fileutil_test
+
+import (
+    // Built-in/core modules.
+    tar "archive/tar"
+    "bytes"
+    gzip "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    ioutil "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+    fileutil "github.com/cuberat-go/fileutil"
+)
+
+func TestOpenArchive(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    nested_str := "nested and compressed\n"
+    var nested bytes.Buffer
+    gz := gzip.NewWriter(&nested)
+    gz.Write([]byte(nested_str))
+    gz.Close()
+
+    type member struct {
+        hdr tar.Header
+        data []byte
+    }
+    mtime := time.Unix(1600000000, 0)
+    members := []member{
+        {tar.Header{Typeflag: tar.TypeDir, Name: "docs/", Mode: 0755,
+            ModTime: mtime}, nil},
+        {tar.Header{Typeflag: tar.TypeReg, Name: "docs/plain.txt",
+            Mode: 0644, ModTime: mtime}, []byte("plain text\n")},
+        {tar.Header{Typeflag: tar.TypeReg, Name: "docs/nested.txt.gz",
+            Mode: 0644, ModTime: mtime}, nested.Bytes()},
+        {tar.Header{Typeflag: tar.TypeSymlink, Name: "docs/link.txt",
+            Linkname: "plain.txt", Mode: 0777, ModTime: mtime}, nil},
+    }
+
+    file := path.Join(out_dir, "test_archive.tar.gz")
+    out_fh, err := fileutil.CreateFile(file)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    tw := tar.NewWriter(out_fh)
+    for _, m := range members {
+        hdr := m.hdr
+        hdr.Size = int64(len(m.data))
+        if err = tw.WriteHeader(&hdr); err != nil {
+            t.Errorf("couldn't write tar header for %q: %s", hdr.Name, err)
+            return
+        }
+        tw.Write(m.data)
+    }
+    if err = tw.Close(); err != nil {
+        t.Errorf("couldn't finish tar archive %q: %s", file, err)
+        return
+    }
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    archive, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer archive.Close()
+
+    expected := []struct {
+        path string
+        data string
+        format string
+        link_target string
+        is_dir bool
+    }{
+        {"docs/", "", "", "", true},
+        {"docs/plain.txt", "plain text\n", "", "", false},
+        {"docs/nested.txt.gz", nested_str, "gzip", "", false},
+        {"docs/link.txt", "", "", "plain.txt", false},
+    }
+
+    for _, exp := range expected {
+        entry, err := archive.Next()
+        if err != nil {
+            t.Errorf("couldn't read entry %q: %s", exp.path, err)
+            return
+        }
+
+        if entry.Path() != exp.path {
+            t.Errorf("got path %q, expected %q", entry.Path(), exp.path)
+        }
+        name := file + "!/" + exp.path
+        if entry.Name() != name {
+            t.Errorf("got name %q, expected %q", entry.Name(), name)
+        }
+        if entry.Format() != exp.format {
+            t.Errorf("%s: got format %q, expected %q", entry.Name(),
+                entry.Format(), exp.format)
+        }
+        if entry.LinkTarget() != exp.link_target {
+            t.Errorf("%s: got link target %q, expected %q", entry.Name(),
+                entry.LinkTarget(), exp.link_target)
+        }
+        if entry.FileInfo().IsDir() != exp.is_dir {
+            t.Errorf("%s: got IsDir() %t, expected %t", entry.Name(),
+                entry.FileInfo().IsDir(), exp.is_dir)
+        }
+        if !entry.FileInfo().ModTime().Equal(mtime) {
+            t.Errorf("%s: got mtime %s, expected %s", entry.Name(),
+                entry.FileInfo().ModTime(), mtime)
+        }
+
+        data_bytes, err := ioutil.ReadAll(entry)
+        if err != nil {
+            t.Errorf("couldn't read entry %q: %s", entry.Name(), err)
+            return
+        }
+        if string(data_bytes) != exp.data {
+            t.Errorf("%s: got contents %q, expected %q", entry.Name(),
+                string(data_bytes), exp.data)
+        }
+    }
+
+    if _, err = archive.Next(); err != io.EOF {
+        t.Errorf("got error %v at end of archive, expected io.EOF", err)
+    }
+}
+
+func TestCreateArchive(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    src_str := "copied from disk\n"
+    src_file := path.Join(out_dir, "source.txt")
+    if err = ioutil.WriteFile(src_file, []byte(src_str), 0640); err != nil {
+        t.Errorf("couldn't write %q: %s", src_file, err)
+        return
+    }
+    mtime := time.Unix(1600000000, 0)
+    if err = os.Chtimes(src_file, mtime, mtime); err != nil {
+        t.Errorf("couldn't set times on %q: %s", src_file, err)
+        return
+    }
+    src_info, err := os.Stat(src_file)
+    if err != nil {
+        t.Errorf("couldn't stat %q: %s", src_file, err)
+        return
+    }
+    dir_info, err := os.Stat(out_dir)
+    if err != nil {
+        t.Errorf("couldn't stat %q: %s", out_dir, err)
+        return
+    }
+
+    file := path.Join(out_dir, "test_archive.tgz")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+
+    dir_w, err := archive.AddFile("reports", dir_info)
+    if err != nil {
+        t.Errorf("couldn't add directory: %s", err)
+        return
+    }
+    dir_w.Close()
+
+    // Two streamed entries open at once, closed in reverse order.
+    first, err := archive.CreateEntry("reports/first.txt", 0600, mtime)
+    if err != nil {
+        t.Errorf("couldn't create entry: %s", err)
+        return
+    }
+    second, err := archive.CreateEntry("reports/second.txt", 0644,
+        time.Time{})
+    if err != nil {
+        t.Errorf("couldn't create entry: %s", err)
+        return
+    }
+    expected_name := file + "!/reports/first.txt"
+    if first.Name() != expected_name {
+        t.Errorf("got entry name %q, expected %q", first.Name(),
+            expected_name)
+    }
+    io.WriteString(first, "first report\n")
+    io.WriteString(second, "second report\n")
+    if err = second.Close(); err != nil {
+        t.Errorf("couldn't close entry %q: %s", second.Name(), err)
+        return
+    }
+
+    src_w, err := archive.AddFile("reports/source.txt", src_info)
+    if err != nil {
+        t.Errorf("couldn't add file: %s", err)
+        return
+    }
+    if _, err = archive.AddFile("y", src_info); err != fileutil.Err_EntryOpen {
+        t.Errorf("got error %v adding a second file, expected %v", err,
+            fileutil.Err_EntryOpen)
+    }
+
+    // A streamed entry can't be added until the file is finished, but can
+    // be closed again afterwards.
+    if err = first.Close(); err != fileutil.Err_EntryOpen {
+        t.Errorf("got error %v closing a streamed entry, expected %v", err,
+            fileutil.Err_EntryOpen)
+    }
+    io.WriteString(src_w, src_str)
+    if err = src_w.Close(); err != nil {
+        t.Errorf("couldn't close entry %q: %s", src_w.Name(), err)
+        return
+    }
+    if err = first.Close(); err != nil {
+        t.Errorf("couldn't close entry %q: %s", first.Name(), err)
+        return
+    }
+
+    if err = archive.Close(); err != nil {
+        t.Errorf("couldn't close archive %q: %s", file, err)
+        return
+    }
+
+    expected := []struct {
+        path string
+        data string
+        mode os.FileMode
+        check_mtime bool
+    }{
+        {"reports/", "", dir_info.Mode().Perm(), false},
+        {"reports/second.txt", "second report\n", 0644, false},
+        {"reports/source.txt", src_str, 0640, true},
+        {"reports/first.txt", "first report\n", 0600, true},
+    }
+
+    reader, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer reader.Close()
+
+    for _, exp := range expected {
+        entry, err := reader.Next()
+        if err != nil {
+            t.Errorf("couldn't read entry %q: %s", exp.path, err)
+            return
+        }
+        if entry.Path() != exp.path {
+            t.Errorf("got path %q, expected %q", entry.Path(), exp.path)
+            continue
+        }
+        if entry.FileInfo().Mode().Perm() != exp.mode {
+            t.Errorf("%s: got mode %s, expected %s", entry.Name(),
+                entry.FileInfo().Mode().Perm(), exp.mode)
+        }
+        if exp.check_mtime && !entry.FileInfo().ModTime().Equal(mtime) {
+            t.Errorf("%s: got mtime %s, expected %s", entry.Name(),
+                entry.FileInfo().ModTime(), mtime)
+        }
+        data_bytes, err := ioutil.ReadAll(entry)
+        if err != nil {
+            t.Errorf("couldn't read entry %q: %s", entry.Name(), err)
+            return
+        }
+        if string(data_bytes) != exp.data {
+            t.Errorf("%s: got contents %q, expected %q", entry.Name(),
+                string(data_bytes), exp.data)
+        }
+    }
+
+    if _, err = reader.Next(); err != io.EOF {
+        t.Errorf("got error %v at end of archive, expected io.EOF", err)
+    }
+}
+
+func TestOpenArchiveBadMember(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "test_archive.tar")
+    err = write_tar(file, []tar_member{
+        {tar.Header{Name: "empty.gz"}, ""},
+        {tar.Header{Name: "ok.txt"}, "still readable\n"},
+    })
+    if err != nil {
+        t.Errorf("couldn't write archive %q: %s", file, err)
+        return
+    }
+
+    archive, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer archive.Close()
+
+    entry, err := archive.Next()
+    if err != nil {
+        t.Errorf("couldn't read entry for empty.gz: %s", err)
+        return
+    }
+    if _, err = ioutil.ReadAll(entry); err == nil {
+        t.Errorf("got no error reading %q", entry.Name())
+    }
+
+    entry, err = archive.Next()
+    if err != nil {
+        t.Errorf("couldn't read entry after empty.gz: %s", err)
+        return
+    }
+    data_bytes, err := ioutil.ReadAll(entry)
+    if err != nil {
+        t.Errorf("couldn't read entry %q: %s", entry.Name(), err)
+        return
+    }
+    if string(data_bytes) != "still readable\n" {
+        t.Errorf("got contents %q, expected %q", string(data_bytes),
+            "still readable\n")
+    }
+}
+
+func TestCreateArchiveDiscard(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Keep spool files where they can be counted.
+    spool_dir := path.Join(out_dir, "spool")
+    if err = os.Mkdir(spool_dir, 0700); err != nil {
+        t.Errorf("couldn't create %q: %s", spool_dir, err)
+        return
+    }
+    old_tmpdir, had_tmpdir := os.LookupEnv("TMPDIR")
+    os.Setenv("TMPDIR", spool_dir)
+    defer func() {
+        if had_tmpdir {
+            os.Setenv("TMPDIR", old_tmpdir)
+        } else {
+            os.Unsetenv("TMPDIR")
+        }
+    }()
+
+    file := path.Join(out_dir, "test_archive.tar")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+
+    kept, err := archive.CreateEntry("kept.txt", 0644, time.Time{})
+    if err != nil {
+        t.Errorf("couldn't create entry: %s", err)
+        return
+    }
+    dropped, err := archive.CreateEntry("dropped.txt", 0644, time.Time{})
+    if err != nil {
+        t.Errorf("couldn't create entry: %s", err)
+        return
+    }
+    io.WriteString(kept, "kept\n")
+    io.WriteString(dropped, "dropped\n")
+    if err = kept.Close(); err != nil {
+        t.Errorf("couldn't close entry %q: %s", kept.Name(), err)
+        return
+    }
+
+    if err = archive.Close(); err != nil {
+        t.Errorf("couldn't close archive %q: %s", file, err)
+        return
+    }
+
+    spools, err := ioutil.ReadDir(spool_dir)
+    if err != nil {
+        t.Errorf("couldn't read %q: %s", spool_dir, err)
+        return
+    }
+    if len(spools) != 0 {
+        t.Errorf("got %d spool files left behind, expected 0", len(spools))
+    }
+
+    reader, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer reader.Close()
+
+    entry, err := reader.Next()
+    if err != nil || entry.Path() != "kept.txt" {
+        t.Errorf("got entry %v and error %v, expected kept.txt", entry, err)
+        return
+    }
+    if _, err = reader.Next(); err != io.EOF {
+        t.Errorf("got error %v after kept.txt, expected io.EOF", err)
+    }
+}
+
+func TestCreateArchiveConcurrent(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "test_archive.tar")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+
+    // Each entry is filled and closed by its own goroutine.
+    num_entries := 8
+    var wg sync.WaitGroup
+    for i := 0; i < num_entries; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            name := fmt.Sprintf("report_%d.txt", i)
+            entry, err := archive.CreateEntry(name, 0644, time.Time{})
+            if err != nil {
+                t.Errorf("couldn't create entry %q: %s", name, err)
+                return
+            }
+            for j := 0; j < 100; j++ {
+                fmt.Fprintf(entry, "%s line %d\n", name, j)
+            }
+            if err = entry.Close(); err != nil {
+                t.Errorf("couldn't close entry %q: %s", name, err)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    if err = archive.Close(); err != nil {
+        t.Errorf("couldn't close archive %q: %s", file, err)
+        return
+    }
+
+    reader, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer reader.Close()
+
+    seen := map[string]bool{}
+    for {
+        entry, err := reader.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            t.Errorf("couldn't get next entry: %s", err)
+            return
+        }
+
+        data_bytes, err := ioutil.ReadAll(entry)
+        if err != nil {
+            t.Errorf("couldn't read %q: %s", entry.Name(), err)
+            return
+        }
+        lines := strings.Split(strings.TrimSuffix(string(data_bytes), "\n"),
+            "\n")
+        for j, line := range lines {
+            expected := fmt.Sprintf("%s line %d", entry.Path(), j)
+            if line != expected {
+                t.Errorf("%s: got line %q, expected %q", entry.Path(), line,
+                    expected)
+                break
+            }
+        }
+        seen[entry.Path()] = true
+    }
+
+    if len(seen) != num_entries {
+        t.Errorf("got %d entries, expected %d", len(seen), num_entries)
+    }
+}
+
+func TestOpenArchiveLimits(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    bomb := string(gzip_bytes(string(make([]byte, 1 << 20))))
+    file := path.Join(out_dir, "test_archive.tar.gz")
+    err = write_tar(file, []tar_member{
+        {tar.Header{Name: "big.txt.gz"}, bomb},
+    })
+    if err != nil {
+        t.Errorf("couldn't write archive %q: %s", file, err)
+        return
+    }
+
+    archive, err := fileutil.OpenArchiveWithOptions(file,
+        fileutil.ArchiveOptions{
+            OpenOptions: fileutil.OpenOptions{MaxDecompressedSize: 1000},
+        })
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer archive.Close()
+
+    entry, err := archive.Next()
+    if err != nil {
+        t.Errorf("couldn't read entry for big.txt.gz: %s", err)
+        return
+    }
+    got, err := ioutil.ReadAll(entry)
+    if !errors.Is(err, fileutil.Err_LimitExceeded) || len(got) != 1000 {
+        t.Errorf("got %d bytes and error %v, expected 1000 bytes and %v",
+            len(got), err, fileutil.Err_LimitExceeded)
+    }
+}
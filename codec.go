@@ -0,0 +1,695 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020 Don Owens <don@regexguy.com>.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+//   this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package fileutil
+
+import (
+    // Built-in/core modules.
+    "bufio"
+    "bytes"
+    bzip2 "compress/bzip2"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    gzip "compress/gzip"
+    zlib "compress/zlib"
+    "io"
+    "math"
+    "strings"
+    "sync"
+
+    // Third-party modules.
+    lzma "github.com/ulikunitz/xz/lzma"
+
+
+    // First-party modules.
+)
+
+// Constructs a decompression layer that reads compressed data from r.
+// Closing the returned io.ReadCloser should not close r.
+type NewReaderFunc func(ctx context.Context, r io.Reader) (io.ReadCloser,
+    error)
+
+// Constructs a compression layer that writes compressed data to w. Closing
+// the returned io.WriteCloser should flush all remaining output to w, but not
+// close w.
+type NewWriterFunc func(ctx context.Context, w io.Writer) (io.WriteCloser,
+    error)
+
+// Describes a compression format to add with `RegisterCodec()`.
+type Codec struct {
+    // Name of the format, e.g., "gzip". Reported by `OpenFileAuto()` and in
+    // *CodecError.
+    Name string
+
+    // File name suffixes for the format, without the leading dot, e.g.,
+    // []string{"gz", "gzip"}. Suffixes are matched without regard to case.
+    Suffixes []string
+
+    // Magic number at the start of compressed data, used to detect the
+    // format by `OpenFileAuto()`. May be empty. If the magic numbers of
+    // several codecs match, the longest wins, then the codec registered
+    // first.
+    Magic []byte
+
+    // Constructor for the decompression layer. If nil, the format can't be
+    // read.
+    NewReader NewReaderFunc
+
+    // Constructor for the compression layer. If nil, the format can't be
+    // written.
+    NewWriter NewWriterFunc
+}
+
+// Adds a compression format to those supported by `OpenFile()`,
+// `CreateFile()`, `AddDecompressionLayer()`, `AddCompressionLayer()`, and
+// related functions. Files whose names end in one of the codec's suffixes
+// are compressed and decompressed with the codec's constructors, and
+// `OpenFileAuto()` recognizes its magic number.
+//
+// Registering a codec with the same name as an existing one, including the
+// built-in gzip, bzip2, xz, and zstd codecs, replaces it. A suffix that
+// already belongs to another codec is taken over by the new one.
+func RegisterCodec(c Codec) error {
+    if c.Name == "" {
+        return errors.New("couldn't register codec: no name given")
+    }
+    if len(c.Suffixes) == 0 && len(c.Magic) == 0 {
+        return fmt.Errorf("couldn't register codec %s: no suffixes or magic " +
+            "number given", c.Name)
+    }
+    if c.NewReader == nil && c.NewWriter == nil {
+        return fmt.Errorf("couldn't register codec %s: no reader or writer " +
+            "given", c.Name)
+    }
+
+    new_codec := &codec{
+        name: c.Name,
+        suffixes: append([]string{}, c.Suffixes...),
+        magic: append([]byte{}, c.Magic...),
+        new_reader: c.NewReader,
+    }
+
+    if c.NewWriter != nil {
+        new_writer := c.NewWriter
+        new_codec.new_writer = func(
+            ctx context.Context,
+            w io.Writer,
+            opts *Options,
+        ) (io.WriteCloser, error) {
+            return new_writer(ctx, w)
+        }
+    }
+
+    register_codec(new_codec)
+
+    return nil
+}
+
+// Describes a compression format handled by external programs, to add with
+// `RegisterExecCodec()`. Each command is represented as a slice of strings,
+// as with `OpenPipesToWriter()`.
+type ExecCodec struct {
+    // Name of the format, as in Codec.
+    Name string
+
+    // File name suffixes for the format, as in Codec.
+    Suffixes []string
+
+    // Magic number at the start of compressed data, as in Codec.
+    Magic []byte
+
+    // Command that reads uncompressed data on its standard input and writes
+    // compressed data to its standard output, e.g.,
+    // []string{"lz4", "-c"}. If empty, the format can't be written.
+    Compress []string
+
+    // Command that reads compressed data on its standard input and writes
+    // uncompressed data to its standard output, e.g.,
+    // []string{"lz4", "-dc"}. If empty, the format can't be read.
+    Decompress []string
+}
+
+// Adds a compression format backed by external programs, e.g., lz4, lzop,
+// or brotli, as if by `RegisterCodec()`. The programs are run each time a
+// file in that format is opened or created, and waited for on `Close()`.
+// Program names without a slash are found with `LookupExec()`.
+func RegisterExecCodec(c ExecCodec) error {
+    new_codec := Codec{
+        Name: c.Name,
+        Suffixes: c.Suffixes,
+        Magic: c.Magic,
+    }
+
+    if len(c.Decompress) > 0 {
+        prog := append([]string{}, c.Decompress...)
+        new_codec.NewReader = func(
+            ctx context.Context,
+            r io.Reader,
+        ) (io.ReadCloser, error) {
+            resolved, err := resolve_prog(prog)
+            if err != nil {
+                return nil, err
+            }
+            return get_reader_pipe_from_exec_with_reader(ctx, r,
+                resolved...)
+        }
+    }
+
+    if len(c.Compress) > 0 {
+        prog := append([]string{}, c.Compress...)
+        new_codec.NewWriter = func(
+            ctx context.Context,
+            w io.Writer,
+        ) (io.WriteCloser, error) {
+            resolved, err := resolve_prog(prog)
+            if err != nil {
+                return nil, err
+            }
+            return get_writer_pipe_from_exec_with_writer(ctx, w,
+                resolved...)
+        }
+    }
+
+    return RegisterCodec(new_codec)
+}
+
+// Returns a copy of prog with the program name replaced by its full path,
+// unless it already contains a slash.
+func resolve_prog(prog []string) ([]string, error) {
+    if strings.Contains(prog[0], "/") {
+        return prog, nil
+    }
+
+    path, err := find_exec(prog[0])
+    if err != nil {
+        return nil, err
+    }
+
+    resolved := append([]string{path}, prog[1:]...)
+    return resolved, nil
+}
+
+type codec struct {
+    name string
+    suffixes []string
+    magic []byte
+
+    // Further checks on the start of the data for formats whose magic
+    // number alone is too weak, given at least header_len bytes.
+    check_header func(header []byte) bool
+    header_len int
+
+    new_reader NewReaderFunc
+    new_writer func(ctx context.Context, w io.Writer,
+        opts *Options) (io.WriteCloser, error)
+}
+
+var codecs = struct {
+    sync.RWMutex
+    by_name map[string]*codec
+    by_suffix map[string]*codec
+    by_exact_suffix map[string]*codec
+
+    // Codecs in the order they were first registered, so that detection
+    // doesn't depend on map iteration order.
+    ordered []*codec
+}{
+    by_name: map[string]*codec{},
+    by_suffix: map[string]*codec{},
+    by_exact_suffix: map[string]*codec{},
+}
+
+// Suffixes that differ only in case from supported ones but belong to Unix
+// compress(1), which isn't supported. They only match a codec registered with
+// exactly that suffix.
+var compress_suffixes = map[string]bool{
+    "Z": true,
+    "taZ": true,
+}
+
+func register_codec(c *codec) {
+    codecs.Lock()
+    defer codecs.Unlock()
+
+    old, ok := codecs.by_name[c.name]
+    if ok {
+        for i := range codecs.ordered {
+            if codecs.ordered[i] == old {
+                codecs.ordered[i] = c
+            }
+        }
+        for _, suffix := range old.suffixes {
+            if codecs.by_suffix[strings.ToLower(suffix)] == old {
+                delete(codecs.by_suffix, strings.ToLower(suffix))
+            }
+            if codecs.by_exact_suffix[suffix] == old {
+                delete(codecs.by_exact_suffix, suffix)
+            }
+        }
+    }
+
+    if !ok {
+        codecs.ordered = append(codecs.ordered, c)
+    }
+
+    codecs.by_name[c.name] = c
+    for _, suffix := range c.suffixes {
+        codecs.by_suffix[strings.ToLower(suffix)] = c
+        codecs.by_exact_suffix[suffix] = c
+    }
+}
+
+// Suffixes that stand for a compressed file in another format, e.g., "tgz"
+// for "tar.gz". Each maps to the inner format and the compression suffix.
+var compound_suffixes = map[string][2]string{
+    "tgz": {"tar", "gz"},
+    "taz": {"tar", "gz"},
+    "tbz": {"tar", "bz2"},
+    "tbz2": {"tar", "bz2"},
+    "txz": {"tar", "xz"},
+    "tzst": {"tar", "zst"},
+}
+
+// Returns the codec registered with name, e.g., "zstd", or nil if there is
+// none.
+func lookup_codec_by_name(name string) *codec {
+    codecs.RLock()
+    defer codecs.RUnlock()
+
+    return codecs.by_name[name]
+}
+
+// Returns the codec registered for suffix, or nil if there is none. Compound
+// suffixes such as "tgz" return the codec for their compression suffix.
+// Matching is case-insensitive, except for the compress(1) suffixes "Z" and
+// "taZ".
+func lookup_codec(suffix string) *codec {
+    codecs.RLock()
+    defer codecs.RUnlock()
+
+    if c, ok := codecs.by_exact_suffix[suffix]; ok {
+        return c
+    }
+    if compress_suffixes[suffix] {
+        return nil
+    }
+
+    suffix = strings.ToLower(suffix)
+
+    if c, ok := codecs.by_suffix[suffix]; ok {
+        return c
+    }
+
+    if compound, ok := compound_suffixes[suffix]; ok {
+        return codecs.by_suffix[compound[1]]
+    }
+
+    return nil
+}
+
+// Returns the codec whose magic number is at the start of br, or nil if
+// there is none. If several match, the one checking the most bytes wins, and
+// among those, the one registered first.
+func detect_codec(br *bufio.Reader) *codec {
+    codecs.RLock()
+    defer codecs.RUnlock()
+
+    max_len := 0
+    for _, c := range codecs.ordered {
+        if c.detect_len() > max_len {
+            max_len = c.detect_len()
+        }
+    }
+    if max_len == 0 {
+        return nil
+    }
+
+    data, _ := br.Peek(max_len)
+
+    var found *codec
+    for _, c := range codecs.ordered {
+        if c.detect_len() == 0 || !bytes.HasPrefix(data, c.magic) {
+            continue
+        }
+        if c.check_header != nil &&
+            (len(data) < c.header_len || !c.check_header(data)) {
+            continue
+        }
+        if found == nil || c.detect_len() > found.detect_len() {
+            found = c
+        }
+    }
+
+    return found
+}
+
+// Returns the number of bytes at the start of the data used to detect the
+// codec, or zero if it can't be detected.
+func (c *codec) detect_len() int {
+    if c.header_len > len(c.magic) {
+        return c.header_len
+    }
+
+    return len(c.magic)
+}
+
+// Checks the 13-byte header of an .lzma file, which has no magic number, in
+// the same way as xz-utils: the properties byte must be valid, the
+// dictionary size must be 2^n or 2^n + 2^(n-1) bytes and at least 4 KiB, and
+// the uncompressed size must be unknown or below 256 GiB.
+func check_lzma_header(header []byte) bool {
+    if header[0] >= 9 * 5 * 5 {
+        return false
+    }
+
+    dict_size := binary.LittleEndian.Uint32(header[1:5])
+    if dict_size < 1 << 12 {
+        return false
+    }
+    if dict_size != math.MaxUint32 {
+        d := dict_size - 1
+        d |= d >> 2
+        d |= d >> 3
+        d |= d >> 4
+        d |= d >> 8
+        d |= d >> 16
+        d++
+        if d != dict_size {
+            return false
+        }
+    }
+
+    size := binary.LittleEndian.Uint64(header[5:13])
+    return size == math.MaxUint64 || size < 1 << 38
+}
+
+// Checks that a bzip2 header is followed by a block size from "1" to "9".
+func check_bzip2_header(header []byte) bool {
+    return header[3] >= '1' && header[3] <= '9'
+}
+
+func init() {
+    register_codec(&codec{
+        name: "gzip",
+        suffixes: []string{"gz", "gzip"},
+        magic: []byte{0x1F, 0x8B},
+        new_reader: new_gzip_reader,
+        new_writer: func(ctx context.Context, w io.Writer,
+            opts *Options) (io.WriteCloser, error) {
+            level, err := gzip_level(opts)
+            if err != nil {
+                return nil, err
+            }
+
+            if opts.GzipConcurrency > 0 {
+                return new_parallel_gzip_writer(w, level,
+                    opts.GzipBlockSize, opts.GzipConcurrency)
+            }
+            if opts.Parallel {
+                pigz_level := "-6"
+                if level >= gzip.NoCompression {
+                    pigz_level = fmt.Sprintf("-%d", level)
+                }
+
+                wc, err := new_parallel_writer(ctx, w,
+                    []string{"pigz", "-c", pigz_level})
+                if wc != nil || err != nil {
+                    return wc, err
+                }
+            }
+            return new_gzip_writer(w, level)
+        },
+    })
+
+    register_codec(&codec{
+        name: "bzip2",
+        suffixes: []string{"bz2", "bzip2"},
+        magic: []byte("BZh"),
+        check_header: check_bzip2_header,
+        header_len: 4,
+        new_reader: new_bz2_reader,
+        new_writer: func(ctx context.Context, w io.Writer,
+            opts *Options) (io.WriteCloser, error) {
+            level, err := bzip2_level(opts)
+            if err != nil {
+                return nil, err
+            }
+
+            if opts.Parallel {
+                wc, err := new_parallel_writer(ctx, w,
+                    []string{"pbzip2", "-z", "-c", fmt.Sprintf("-%d", level)})
+                if wc != nil || err != nil {
+                    return wc, err
+                }
+            }
+            return new_bz2_writer(w, level)
+        },
+    })
+
+    register_codec(&codec{
+        name: "xz",
+        suffixes: []string{"xz"},
+        magic: []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
+        new_reader: new_xz_reader,
+        new_writer: func(ctx context.Context, w io.Writer,
+            opts *Options) (io.WriteCloser, error) {
+            level, extreme, err := xz_level(opts)
+            if err != nil {
+                return nil, err
+            }
+
+            if opts.Parallel {
+                wc, err := new_parallel_writer(ctx, w,
+                    []string{"pixz", xz_preset(level, extreme)})
+                if wc != nil || err != nil {
+                    return wc, err
+                }
+            }
+            return new_xz_writer(ctx, w, level, extreme, opts.Parallel)
+        },
+    })
+
+    register_codec(&codec{
+        name: "zlib",
+        suffixes: []string{"zlib", "z"},
+        new_reader: new_zlib_reader,
+        new_writer: func(ctx context.Context, w io.Writer,
+            opts *Options) (io.WriteCloser, error) {
+            level, err := gzip_level(opts)
+            if err != nil {
+                return nil, err
+            }
+            return new_zlib_writer(w, level)
+        },
+    })
+
+    register_codec(&codec{
+        name: "lzma",
+        suffixes: []string{"lzma"},
+        check_header: check_lzma_header,
+        header_len: 13,
+        new_reader: new_lzma_reader,
+        new_writer: func(ctx context.Context, w io.Writer,
+            opts *Options) (io.WriteCloser, error) {
+            return new_lzma_writer(w)
+        },
+    })
+
+    register_codec(&codec{
+        name: "zstd",
+        suffixes: []string{"zst", "zstd"},
+        magic: []byte{0x28, 0xB5, 0x2F, 0xFD},
+        new_reader: func(ctx context.Context,
+            r io.Reader) (io.ReadCloser, error) {
+            return new_zstd_reader(r)
+        },
+        new_writer: func(ctx context.Context, w io.Writer,
+            opts *Options) (io.WriteCloser, error) {
+            level, err := zstd_level(opts)
+            if err != nil {
+                return nil, err
+            }
+            return new_zstd_writer(w, level)
+        },
+    })
+}
+
+func new_gzip_reader(
+    ctx context.Context,
+    r io.Reader,
+) (io.ReadCloser, error) {
+    new_reader, err := gzip.NewReader(r)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create gzip reader: %w", err)
+    }
+
+    close_func := func() error {
+        return new_reader.Close()
+    }
+
+    return ReadCloserFromReader(new_reader, close_func), nil
+}
+
+// Returns the gzip or zlib compression level to use for opts.
+func gzip_level(opts *Options) (int, error) {
+    level := opts.GzipLevel
+    if level == 0 && !opts.GzipLevelSet {
+        level = gzip.BestCompression
+    }
+
+    if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+        return 0, fmt.Errorf("invalid gzip compression level: %d", level)
+    }
+
+    return level, nil
+}
+
+// Returns the bzip2 compression level to use for opts.
+func bzip2_level(opts *Options) (int, error) {
+    if opts.Bzip2Level == 0 {
+        return 9, nil
+    }
+
+    if opts.Bzip2Level < 1 || opts.Bzip2Level > 9 {
+        return 0, fmt.Errorf("invalid bzip2 compression level: %d",
+            opts.Bzip2Level)
+    }
+
+    return opts.Bzip2Level, nil
+}
+
+// Returns the zstd compression level to use for opts, or zero for the
+// default.
+func zstd_level(opts *Options) (int, error) {
+    if opts.ZstdLevel < 0 || opts.ZstdLevel > 22 {
+        return 0, fmt.Errorf("invalid zstd compression level: %d",
+            opts.ZstdLevel)
+    }
+
+    return opts.ZstdLevel, nil
+}
+
+// Returns the xz preset to use for opts, and whether to use extreme mode.
+func xz_level(opts *Options) (int, bool, error) {
+    if opts.XzLevel == 0 && !opts.XzLevelSet {
+        return 6, true, nil
+    }
+
+    if opts.XzLevel < 0 || opts.XzLevel >= len(xz_dict_sizes) {
+        return 0, false, fmt.Errorf("invalid xz preset: %d", opts.XzLevel)
+    }
+
+    return opts.XzLevel, false, nil
+}
+
+func new_gzip_writer(w io.Writer, level int) (io.WriteCloser, error) {
+    gzip_writer, err := gzip.NewWriterLevel(w, level)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create gzip writer: %w", err)
+    }
+
+    close_func := func() error {
+        gzip_writer.Flush()
+        return gzip_writer.Close()
+    }
+
+    return WriteCloserFromWriter(gzip_writer, close_func), nil
+}
+
+// zlib streams have no reliable magic number, so they are only recognized
+// by suffix.
+func new_zlib_reader(
+    ctx context.Context,
+    r io.Reader,
+) (io.ReadCloser, error) {
+    new_reader, err := zlib.NewReader(r)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create zlib reader: %w", err)
+    }
+
+    return new_reader, nil
+}
+
+func new_zlib_writer(w io.Writer, level int) (io.WriteCloser, error) {
+    zlib_writer, err := zlib.NewWriterLevel(w, level)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create zlib writer: %w", err)
+    }
+
+    return zlib_writer, nil
+}
+
+func new_lzma_reader(
+    ctx context.Context,
+    r io.Reader,
+) (io.ReadCloser, error) {
+    new_reader, err := lzma.NewReader(r)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create lzma reader: %w", err)
+    }
+
+    return ReadCloserFromReader(new_reader, nil), nil
+}
+
+func new_lzma_writer(w io.Writer) (io.WriteCloser, error) {
+    lzma_writer, err := lzma.NewWriter(w)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create lzma writer: %w", err)
+    }
+
+    return lzma_writer, nil
+}
+
+func new_bz2_reader(
+    ctx context.Context,
+    r io.Reader,
+) (io.ReadCloser, error) {
+    new_reader := bzip2.NewReader(r)
+    close_func := func() error { return nil }
+    return ReadCloserFromReader(new_reader, close_func), nil
+}
+
+// Returns a compression layer that runs the first of the parallel
+// compressors in progs that can be found. Returns nil without an error if
+// none of them can be found.
+func new_parallel_writer(
+    ctx context.Context,
+    w io.Writer,
+    progs ...[]string,
+) (io.WriteCloser, error) {
+    for _, prog := range progs {
+        resolved, err := resolve_prog(prog)
+        if err != nil {
+            continue
+        }
+
+        return get_writer_pipe_from_exec_with_writer(ctx, w, resolved...)
+    }
+
+    return nil, nil
+}
@@ -0,0 +1,259 @@
+package fileutil_test
+
+import (
+    // Built-in/core modules.
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    ioutil "io/ioutil"
+    "os"
+    exec "os/exec"
+    "path"
+    "strings"
+    "testing"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+    fileutil "github.com/cuberat-go/fileutil"
+)
+
+var xor_magic = []byte("XOR1")
+
+type xor_stream struct {
+    r io.Reader
+    w io.Writer
+}
+
+func (x *xor_stream) Read(p []byte) (int, error) {
+    n, err := x.r.Read(p)
+    for i := 0; i < n; i++ {
+        p[i] ^= 0x5A
+    }
+    return n, err
+}
+
+func (x *xor_stream) Write(p []byte) (int, error) {
+    buf := make([]byte, len(p))
+    for i := range p {
+        buf[i] = p[i] ^ 0x5A
+    }
+    return x.w.Write(buf)
+}
+
+func (x *xor_stream) Close() error {
+    return nil
+}
+
+func register_xor_codec() error {
+    return fileutil.RegisterCodec(fileutil.Codec{
+        Name: "xor",
+        Suffixes: []string{"xor"},
+        Magic: xor_magic,
+        NewReader: func(ctx context.Context,
+            r io.Reader) (io.ReadCloser, error) {
+            magic := make([]byte, len(xor_magic))
+            if _, err := io.ReadFull(r, magic); err != nil {
+                return nil, err
+            }
+            if string(magic) != string(xor_magic) {
+                return nil, errors.New("bad magic number")
+            }
+            return &xor_stream{r: r}, nil
+        },
+        NewWriter: func(ctx context.Context,
+            w io.Writer) (io.WriteCloser, error) {
+            if _, err := w.Write(xor_magic); err != nil {
+                return nil, err
+            }
+            return &xor_stream{w: w}, nil
+        },
+    })
+}
+
+func TestRegisterCodec(t *testing.T) {
+    if err := register_xor_codec(); err != nil {
+        t.Errorf("couldn't register codec: %s", err)
+        return
+    }
+
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    test_str := "in-house format\n"
+    file := path.Join(out_dir, "test_out.xor")
+    out_fh, err := fileutil.CreateFile(file)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    fmt.Fprintf(out_fh, "%s", test_str)
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    in_fh, err := os.Open(file)
+    if err != nil {
+        t.Errorf("couldn't open %q: %s", file, err)
+        return
+    }
+    format := fileutil.DetectCompression(bufio.NewReader(in_fh))
+    in_fh.Close()
+    if format != "xor" {
+        t.Errorf("got format %q, expected %q", format, "xor")
+    }
+
+    in, err := fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open file %q for input: %s", file, err)
+        return
+    }
+    defer in.Close()
+
+    data_bytes, err := ioutil.ReadAll(in)
+    if err != nil {
+        t.Errorf("couldn't read all from file %q: %s", file, err)
+        return
+    }
+    if string(data_bytes) != test_str {
+        t.Errorf("file contents incorrect: got %q, expected %q",
+            string(data_bytes), test_str)
+    }
+}
+
+func TestDetectCompressionOrder(t *testing.T) {
+    new_reader := func(ctx context.Context,
+        r io.Reader) (io.ReadCloser, error) {
+        return ioutil.NopCloser(r), nil
+    }
+
+    // Codecs with the same magic number are tried in registration order,
+    // and registering one again keeps its place.
+    for _, name := range []string{"tie_a", "tie_b", "tie_c", "tie_a"} {
+        err := fileutil.RegisterCodec(fileutil.Codec{
+            Name: name,
+            Magic: []byte("TIE!"),
+            NewReader: new_reader,
+        })
+        if err != nil {
+            t.Errorf("couldn't register codec %s: %s", name, err)
+            return
+        }
+    }
+
+    for i := 0; i < 20; i++ {
+        br := bufio.NewReader(strings.NewReader("TIE!data"))
+        if format := fileutil.DetectCompression(br); format != "tie_a" {
+            t.Errorf("got format %q, expected %q", format, "tie_a")
+            return
+        }
+    }
+}
+
+func TestRegisterCodecInvalid(t *testing.T) {
+    err := fileutil.RegisterCodec(fileutil.Codec{Suffixes: []string{"x"}})
+    if err == nil {
+        t.Errorf("expected error registering codec with no name")
+    }
+
+    err = fileutil.RegisterCodec(fileutil.Codec{Name: "nothing",
+        Suffixes: []string{"nothing"}})
+    if err == nil {
+        t.Errorf("expected error registering codec with no constructors")
+    }
+}
+
+func TestRegisterExecCodec(t *testing.T) {
+    if _, err := exec.LookPath("gzip"); err != nil {
+        t.Skip(fmt.Sprintf("gzip program not found: %s", err))
+        return
+    }
+
+    err := fileutil.RegisterExecCodec(fileutil.ExecCodec{
+        Name: "external-gzip",
+        Suffixes: []string{"egz"},
+        Compress: []string{"gzip", "-c"},
+        Decompress: []string{"gzip", "-dc"},
+    })
+    if err != nil {
+        t.Errorf("couldn't register codec: %s", err)
+        return
+    }
+
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    test_str := "compressed by an external program\n"
+    file := path.Join(out_dir, "test_out.egz")
+    out_fh, err := fileutil.CreateFile(file)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    fmt.Fprintf(out_fh, "%s", test_str)
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    got, err := read_file(file)
+    if err != nil {
+        t.Errorf("%s", err)
+        return
+    }
+    if got != test_str {
+        t.Errorf("file contents incorrect: got %q, expected %q", got,
+            test_str)
+    }
+
+    // The output should also be readable as ordinary gzip.
+    renamed := path.Join(out_dir, "test_out.gz")
+    if err = os.Rename(file, renamed); err != nil {
+        t.Errorf("couldn't rename %q: %s", file, err)
+        return
+    }
+
+    got, err = read_file(renamed)
+    if err != nil {
+        t.Errorf("%s", err)
+        return
+    }
+    if got != test_str {
+        t.Errorf("file contents incorrect: got %q, expected %q", got,
+            test_str)
+    }
+}
+
+// Reads the whole of file, decompressing it with OpenFile().
+func read_file(file string) (string, error) {
+    in, err := fileutil.OpenFile(file)
+    if err != nil {
+        return "", fmt.Errorf("couldn't open file %q for input: %s", file,
+            err)
+    }
+
+    data_bytes, err := ioutil.ReadAll(in)
+    if err != nil {
+        in.Close()
+        return "", fmt.Errorf("couldn't read all from file %q: %s", file,
+            err)
+    }
+
+    if err = in.Close(); err != nil {
+        return "", fmt.Errorf("couldn't close file %q: %s", file, err)
+    }
+
+    return string(data_bytes), nil
+}
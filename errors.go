@@ -0,0 +1,184 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020 Don Owens <don@regexguy.com>.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+//   this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package fileutil
+
+import (
+    // Built-in/core modules.
+    "fmt"
+    "strings"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+)
+
+// Describes a failure in a compression or decompression layer, such as
+// corrupt compressed input. Errors from reading or writing the underlying
+// stream are returned unchanged rather than as a *CodecError.
+type CodecError struct {
+    // The name of the compression format, e.g., "gzip".
+    Format string
+
+    // The operation that failed: "compress" or "decompress".
+    Op string
+
+    // The underlying error.
+    Err error
+}
+
+func (e *CodecError) Error() string {
+    return fmt.Sprintf("couldn't %s %s data: %s", e.Op, e.Format, e.Err)
+}
+
+func (e *CodecError) Unwrap() error {
+    return e.Err
+}
+
+// Describes decompressed data that exceeded a limit set in OpenOptions. It
+// matches Err_LimitExceeded with `errors.Is()`.
+type DecompressionLimitError struct {
+    // The name of the compression format, e.g., "gzip".
+    Format string
+
+    // The size limit exceeded, or zero if it was the ratio limit.
+    MaxSize int64
+
+    // The expansion ratio limit exceeded, or zero if it was the size limit.
+    MaxRatio float64
+
+    // Bytes of compressed input read when the limit was exceeded.
+    Compressed int64
+
+    // Bytes of decompressed data returned when the limit was exceeded.
+    Decompressed int64
+}
+
+func (e *DecompressionLimitError) Error() string {
+    if e.MaxSize > 0 {
+        return fmt.Sprintf("decompressed %s data exceeds %d bytes", e.Format,
+            e.MaxSize)
+    }
+
+    return fmt.Sprintf(
+        "decompressed %s data exceeds %g times its compressed size " +
+            "(%d bytes from %d)", e.Format, e.MaxRatio, e.Decompressed,
+        e.Compressed)
+}
+
+func (e *DecompressionLimitError) Unwrap() error {
+    return Err_LimitExceeded
+}
+
+// Describes an HTTP response with an unexpected status code.
+type HTTPStatusError struct {
+    // The URL requested.
+    URL string
+
+    // The status code of the response, e.g., 404.
+    StatusCode int
+
+    // The status line of the response, e.g., "404 Not Found".
+    Status string
+}
+
+func (e *HTTPStatusError) Error() string {
+    return fmt.Sprintf("couldn't fetch %s: %s", e.URL, e.Status)
+}
+
+// Describes an external program that couldn't be found.
+type ExecNotFoundError struct {
+    // The name of the program.
+    Name string
+
+    // The underlying error.
+    Err error
+}
+
+func (e *ExecNotFoundError) Error() string {
+    return fmt.Sprintf("couldn't find executable %s", e.Name)
+}
+
+func (e *ExecNotFoundError) Unwrap() error {
+    return e.Err
+}
+
+// Describes an external program that exited unsuccessfully.
+type ExitError struct {
+    // The program and its arguments.
+    Command []string
+
+    // The exit code of the program, or -1 if it was killed by a signal.
+    ExitCode int
+
+    // The last few kilobytes written by the program to its standard error.
+    Stderr string
+
+    // The underlying *exec.ExitError.
+    Err error
+}
+
+func (e *ExitError) Error() string {
+    msg := fmt.Sprintf("%s: process exited with code %d",
+        strings.Join(e.Command, " "), e.ExitCode)
+    if e.ExitCode < 0 && e.Err != nil {
+        msg = fmt.Sprintf("%s: %s", strings.Join(e.Command, " "), e.Err)
+    }
+
+    // The last line is usually the program's error message.
+    lines := strings.Split(strings.TrimSpace(e.Stderr), "\n")
+    if last_line := lines[len(lines) - 1]; last_line != "" {
+        msg = fmt.Sprintf("%s: %s", msg, last_line)
+    }
+
+    return msg
+}
+
+func (e *ExitError) Unwrap() error {
+    return e.Err
+}
+
+// Describes a failure in one of the programs run by `OpenPipesToWriter()` or
+// `OpenPipesFromReader()`.
+type PipelineError struct {
+    // Index of the failed program in the list of commands.
+    Stage int
+
+    // The program and its arguments.
+    Command []string
+
+    // The underlying error, e.g., an *ExitError.
+    Err error
+}
+
+func (e *PipelineError) Error() string {
+    return fmt.Sprintf("pipeline stage %d: %s", e.Stage, e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+    return e.Err
+}
@@ -0,0 +1,185 @@
+package fileutil_test
+
+import (
+    // Built-in/core modules.
+    "bytes"
+    "errors"
+    "io"
+    ioutil "io/ioutil"
+    "os"
+    exec "os/exec"
+    "path"
+    "strings"
+    "testing"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+    fileutil "github.com/cuberat-go/fileutil"
+)
+
+func TestCodecError(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Not gzip data at all.
+    file := path.Join(out_dir, "bad_header.gz")
+    if err = ioutil.WriteFile(file, []byte("plain text\n"), 0644); err != nil {
+        t.Errorf("couldn't write test file %q: %s", file, err)
+        return
+    }
+
+    _, err = fileutil.OpenFile(file)
+    codec_err := &fileutil.CodecError{}
+    if !errors.As(err, &codec_err) {
+        t.Errorf("expected *CodecError, got %v", err)
+    } else if codec_err.Format != "gzip" || codec_err.Op != "decompress" {
+        t.Errorf("got format %q, op %q, expected gzip decompress",
+            codec_err.Format, codec_err.Op)
+    }
+
+    // Valid header, but truncated.
+    file = path.Join(out_dir, "truncated.gz")
+    out_fh, err := fileutil.CreateFile(file)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    out_fh.Write(bytes.Repeat([]byte("some text to compress\n"), 1000))
+    out_fh.Close()
+
+    data_bytes, err := ioutil.ReadFile(file)
+    if err != nil {
+        t.Errorf("couldn't read %q: %s", file, err)
+        return
+    }
+    err = ioutil.WriteFile(file, data_bytes[:len(data_bytes) / 2], 0644)
+    if err != nil {
+        t.Errorf("couldn't truncate %q: %s", file, err)
+        return
+    }
+
+    in, err := fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open file %q for input: %s", file, err)
+        return
+    }
+    defer in.Close()
+
+    _, err = ioutil.ReadAll(in)
+    if !errors.As(err, &codec_err) {
+        t.Errorf("expected *CodecError, got %v", err)
+    }
+    if !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Errorf("expected to wrap io.ErrUnexpectedEOF, got %v", err)
+    }
+}
+
+type failing_reader struct{}
+
+var err_failing_read = errors.New("read failed")
+
+func (r failing_reader) Read(p []byte) (int, error) {
+    return 0, err_failing_read
+}
+
+func TestCodecErrorPassesIOErrors(t *testing.T) {
+    _, err := fileutil.AddDecompressionLayer(failing_reader{}, "gz")
+    if !errors.Is(err, err_failing_read) {
+        t.Errorf("expected I/O error, got %v", err)
+    }
+
+    codec_err := &fileutil.CodecError{}
+    if errors.As(err, &codec_err) {
+        t.Errorf("I/O error reported as *CodecError: %v", err)
+    }
+}
+
+func TestPipelineErrors(t *testing.T) {
+    cmds := [][]string{
+        []string{"cat"},
+        []string{"/nonexistent/fileutil_test_prog"},
+    }
+
+    var out bytes.Buffer
+    _, err := fileutil.OpenPipesToWriter(&out, cmds)
+
+    pipe_err := &fileutil.PipelineError{}
+    if !errors.As(err, &pipe_err) {
+        t.Errorf("expected *PipelineError, got %v", err)
+    } else if pipe_err.Stage != 1 {
+        t.Errorf("got stage %d, expected 1", pipe_err.Stage)
+    }
+
+    not_found_err := &fileutil.ExecNotFoundError{}
+    if !errors.As(err, &not_found_err) {
+        t.Errorf("expected *ExecNotFoundError, got %v", err)
+    }
+
+    cmds = [][]string{
+        []string{"sh", "-c", "cat; exit 3"},
+        []string{"cat"},
+        []string{"sh", "-c", "cat; exit 4"},
+    }
+
+    rc, err := fileutil.OpenPipesFromReader(strings.NewReader("x\n"), cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesFromReader: %s", err)
+        return
+    }
+    ioutil.ReadAll(rc)
+
+    err = rc.Close()
+    if !errors.As(err, &pipe_err) {
+        t.Errorf("expected *PipelineError, got %v", err)
+    }
+
+    exit_err := &fileutil.ExitError{}
+    if !errors.As(err, &exit_err) {
+        t.Errorf("expected *ExitError, got %v", err)
+    }
+
+    var generic_exit_err *exec.ExitError
+    if !errors.As(err, &generic_exit_err) {
+        t.Errorf("expected *exec.ExitError, got %v", err)
+    }
+}
+
+func TestPipelineErrorUpstream(t *testing.T) {
+    cmds := [][]string{
+        []string{"sh", "-c", "cat; exit 3"},
+        []string{"cat"},
+    }
+
+    rc, err := fileutil.OpenPipesFromReader(strings.NewReader("x\n"), cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesFromReader: %s", err)
+        return
+    }
+
+    got_bytes, err := ioutil.ReadAll(rc)
+    if err != nil {
+        t.Errorf("read failed for a successful last program: %s", err)
+    }
+    if string(got_bytes) != "x\n" {
+        t.Errorf("got %q, expected %q", got_bytes, "x\n")
+    }
+
+    err = rc.Close()
+    pipe_err := &fileutil.PipelineError{}
+    if !errors.As(err, &pipe_err) {
+        t.Errorf("expected *PipelineError, got %v", err)
+        return
+    }
+    if pipe_err.Stage != 0 {
+        t.Errorf("got stage %d, expected 0", pipe_err.Stage)
+    }
+    if strings.Contains(err.Error(), "stage 1") {
+        t.Errorf("successful stage 1 reported as failed: %v", err)
+    }
+}
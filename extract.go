@@ -0,0 +1,315 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020 Don Owens <don@regexguy.com>.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+//   this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package fileutil
+
+import (
+    // Built-in/core modules.
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+)
+
+// Returned by `ExtractArchive()` for an entry that could write outside the
+// destination directory, or that isn't a regular file, directory, or link.
+var Err_UnsafeEntry = errors.New("unsafe archive entry")
+
+// Returned by `ExtractArchive()` when an archive exceeds the limits in
+// ExtractOptions. A *DecompressionLimitError also matches it with
+// `errors.Is()`.
+var Err_LimitExceeded = errors.New("limit exceeded")
+
+// Options for `ExtractArchive()`. The zero value sets no limits.
+type ExtractOptions struct {
+    // Maximum total size in bytes of the extracted files. Zero means no
+    // limit.
+    MaxTotalSize int64
+
+    // Maximum number of entries in the archive. Zero means no limit.
+    MaxEntries int
+}
+
+// Extracts the tar or zip archive `src`, opened as with `OpenArchive()`, into
+// the directory `dest_dir`, creating it if needed. Files are written as
+// stored in the archive, so a member named "data.csv.gz" stays compressed.
+// Entries with absolute paths, ".." components, or backslashes, symbolic and
+// hard links pointing outside `dest_dir`, symbolic links with ".." after a
+// name in their target, entries that would be written through a symbolic
+// link, and device files, pipes, and sockets are rejected with an error
+// wrapping Err_UnsafeEntry. Exceeding the limits in `opts` gives an error
+// wrapping Err_LimitExceeded. Files extracted before an error are left in
+// place.
+func ExtractArchive(src, dest_dir string, opts ExtractOptions) error {
+    archive, err := OpenArchiveWithOptions(src, ArchiveOptions{Raw: true})
+    if err != nil {
+        return err
+    }
+    defer archive.Close()
+
+    if err = os.MkdirAll(dest_dir, 0777); err != nil {
+        return fmt.Errorf("couldn't create directory %s: %w", dest_dir, err)
+    }
+
+    var total int64
+    count := 0
+    for {
+        entry, err := archive.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("couldn't read archive %s: %w", archive.Name(),
+                err)
+        }
+
+        count++
+        if opts.MaxEntries > 0 && count > opts.MaxEntries {
+            return fmt.Errorf("couldn't extract %s: more than %d entries: %w",
+                archive.Name(), opts.MaxEntries, Err_LimitExceeded)
+        }
+
+        max_size := int64(-1)
+        if opts.MaxTotalSize > 0 {
+            max_size = opts.MaxTotalSize - total
+        }
+
+        n, err := extract_entry(entry, dest_dir, max_size)
+        total += n
+        if err != nil {
+            return fmt.Errorf("couldn't extract %s: %w", entry.Name(), err)
+        }
+    }
+
+    return nil
+}
+
+// Extracts a single entry, writing at most max_size bytes unless max_size is
+// negative. Returns the number of bytes written.
+func extract_entry(entry ArchiveEntry, dest_dir string,
+    max_size int64) (int64, error) {
+    rel, err := safe_entry_path(entry.Path())
+    if err != nil {
+        return 0, err
+    }
+    if err = check_no_symlinks(dest_dir, rel); err != nil {
+        return 0, err
+    }
+
+    target := filepath.Join(dest_dir, filepath.FromSlash(rel))
+    info := entry.FileInfo()
+    mode := info.Mode()
+
+    if mode.IsDir() {
+        if err = os.MkdirAll(target, mode.Perm() | 0700); err != nil {
+            return 0, err
+        }
+        return 0, nil
+    }
+
+    if rel == "." {
+        return 0, fmt.Errorf("path %q is the destination directory: %w",
+            entry.Path(), Err_UnsafeEntry)
+    }
+    if err = os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+        return 0, err
+    }
+
+    switch {
+    case mode & os.ModeSymlink != 0:
+        link := entry.LinkTarget()
+        if link == "" {
+            // A link whose target couldn't be read reports why from Read().
+            if _, err = entry.Read(make([]byte, 1)); err != nil &&
+                err != io.EOF {
+                return 0, err
+            }
+            return 0, fmt.Errorf("symbolic link with no target: %w",
+                Err_UnsafeEntry)
+        }
+        if path.IsAbs(link) || filepath.IsAbs(link) {
+            return 0, fmt.Errorf("symbolic link to absolute path %q: %w",
+                link, Err_UnsafeEntry)
+        }
+        if err = check_link_target(link); err != nil {
+            return 0, err
+        }
+        resolved := path.Join(path.Dir(rel), link)
+        if resolved == ".." || strings.HasPrefix(resolved, "../") {
+            return 0, fmt.Errorf(
+                "symbolic link to %q leaves destination: %w", link,
+                Err_UnsafeEntry)
+        }
+        return 0, os.Symlink(link, target)
+
+    case mode.IsRegular() && entry.LinkTarget() != "":
+        link_rel, err := safe_entry_path(entry.LinkTarget())
+        if err != nil {
+            return 0, err
+        }
+        if err = check_no_symlinks(dest_dir, link_rel); err != nil {
+            return 0, err
+        }
+        return 0, os.Link(
+            filepath.Join(dest_dir, filepath.FromSlash(link_rel)), target)
+
+    case mode.IsRegular():
+        return extract_file(entry, target, max_size)
+    }
+
+    return 0, fmt.Errorf("unsupported file type %s: %w", mode.Type(),
+        Err_UnsafeEntry)
+}
+
+func extract_file(entry ArchiveEntry, target string,
+    max_size int64) (int64, error) {
+    out_fh, err := os.OpenFile(target, os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+        entry.FileInfo().Mode().Perm())
+    if err != nil {
+        return 0, err
+    }
+
+    var r io.Reader = entry
+    if max_size >= 0 {
+        r = io.LimitReader(entry, max_size + 1)
+    }
+
+    n, err := io.Copy(out_fh, r)
+    if close_err := out_fh.Close(); err == nil {
+        err = close_err
+    }
+    if err != nil {
+        return n, err
+    }
+
+    if max_size >= 0 && n > max_size {
+        return n, fmt.Errorf("total size exceeds limit: %w",
+            Err_LimitExceeded)
+    }
+
+    mtime := entry.FileInfo().ModTime()
+    if err = os.Chtimes(target, mtime, mtime); err != nil {
+        return n, err
+    }
+
+    return n, nil
+}
+
+// Checks that an entry path is relative and has no ".." components, and
+// returns it cleaned. Backslashes are rejected, since they separate path
+// components on Windows, as are names Windows reserves, such as "NUL".
+func safe_entry_path(name string) (string, error) {
+    if name == "" {
+        return "", fmt.Errorf("empty path: %w", Err_UnsafeEntry)
+    }
+    if path.IsAbs(name) || filepath.IsAbs(name) {
+        return "", fmt.Errorf("absolute path %q: %w", name, Err_UnsafeEntry)
+    }
+    if strings.Contains(name, "\\") {
+        return "", fmt.Errorf("path %q contains a backslash: %w", name,
+            Err_UnsafeEntry)
+    }
+
+    for _, part := range strings.Split(name, "/") {
+        if part == ".." {
+            return "", fmt.Errorf("path %q leaves destination: %w", name,
+                Err_UnsafeEntry)
+        }
+    }
+
+    cleaned := path.Clean(name)
+    if !filepath.IsLocal(filepath.FromSlash(cleaned)) {
+        return "", fmt.Errorf("path %q isn't local: %w", name,
+            Err_UnsafeEntry)
+    }
+
+    return cleaned, nil
+}
+
+// Checks that ".." appears only at the start of a symbolic link target, and
+// that the target has no backslashes, which Windows takes as separators. The
+// target is resolved on disk rather than as text, so a ".." after another
+// component, as in "d/l/..", would step back out of wherever "d/l" leads,
+// possibly through a link made earlier or later in the archive. Leading ".."
+// components only climb the real directories above the link, which are
+// checked against the destination by the caller.
+func check_link_target(link string) error {
+    if strings.Contains(link, "\\") {
+        return fmt.Errorf("symbolic link to %q contains a backslash: %w",
+            link, Err_UnsafeEntry)
+    }
+
+    seen_name := false
+    for _, part := range strings.Split(link, "/") {
+        switch part {
+        case "", ".":
+        case "..":
+            if seen_name {
+                return fmt.Errorf(
+                    "symbolic link to %q has \"..\" after a name: %w", link,
+                    Err_UnsafeEntry)
+            }
+        default:
+            seen_name = true
+        }
+    }
+
+    return nil
+}
+
+// Checks that no existing component of rel below dest_dir, including the
+// last, is a symbolic link, so writing to it can't leave dest_dir.
+func check_no_symlinks(dest_dir, rel string) error {
+    if rel == "." {
+        return nil
+    }
+
+    cur := dest_dir
+    for _, part := range strings.Split(rel, "/") {
+        cur = filepath.Join(cur, part)
+        info, err := os.Lstat(cur)
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if info.Mode() & os.ModeSymlink != 0 {
+            return fmt.Errorf("path %q passes through symbolic link %s: %w",
+                rel, cur, Err_UnsafeEntry)
+        }
+    }
+
+    return nil
+}
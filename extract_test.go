@@ -0,0 +1,275 @@
+package fileutil_test
+
+import (
+    // Built-in/core modules.
+    tar "archive/tar"
+    "errors"
+    ioutil "io/ioutil"
+    "os"
+    "path"
+    "testing"
+    "time"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+    fileutil "github.com/cuberat-go/fileutil"
+)
+
+type tar_member struct {
+    hdr tar.Header
+    data string
+}
+
+// Writes a tar archive with the given members, compressed according to the
+// file's suffix.
+func write_tar(file string, members []tar_member) error {
+    out_fh, err := fileutil.CreateFile(file)
+    if err != nil {
+        return err
+    }
+
+    tw := tar.NewWriter(out_fh)
+    for _, m := range members {
+        hdr := m.hdr
+        if hdr.Typeflag == 0 {
+            hdr.Typeflag = tar.TypeReg
+        }
+        if hdr.Mode == 0 {
+            hdr.Mode = 0644
+        }
+        hdr.Size = int64(len(m.data))
+        if err = tw.WriteHeader(&hdr); err != nil {
+            out_fh.Close()
+            return err
+        }
+        tw.Write([]byte(m.data))
+    }
+
+    if err = tw.Close(); err != nil {
+        out_fh.Close()
+        return err
+    }
+
+    return out_fh.Close()
+}
+
+func TestExtractArchive(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    mtime := time.Unix(1600000000, 0)
+    compressed := string(gzip_bytes("hello\n"))
+    file := path.Join(out_dir, "test_archive.tar.xz")
+    err = write_tar(file, []tar_member{
+        {tar.Header{Typeflag: tar.TypeDir, Name: "top/", Mode: 0755}, ""},
+        {tar.Header{Name: "top/a.txt", Mode: 0600, ModTime: mtime},
+            "file a\n"},
+        {tar.Header{Name: "top/sub/b.txt"}, "file b\n"},
+        {tar.Header{Typeflag: tar.TypeSymlink, Name: "top/sub/link.txt",
+            Linkname: "../a.txt"}, ""},
+        {tar.Header{Typeflag: tar.TypeLink, Name: "top/hard.txt",
+            Linkname: "top/sub/b.txt"}, ""},
+        {tar.Header{Name: "top/data.csv.gz"}, compressed},
+    })
+    if err != nil {
+        t.Errorf("couldn't write archive %q: %s", file, err)
+        return
+    }
+
+    dest_dir := path.Join(out_dir, "dest")
+    if err = fileutil.ExtractArchive(file, dest_dir,
+        fileutil.ExtractOptions{}); err != nil {
+        t.Errorf("couldn't extract %q: %s", file, err)
+        return
+    }
+
+    expected := map[string]string{
+        "top/a.txt": "file a\n",
+        "top/sub/b.txt": "file b\n",
+        "top/sub/link.txt": "file a\n",
+        "top/hard.txt": "file b\n",
+        "top/data.csv.gz": compressed,
+    }
+    for name, exp := range expected {
+        data_bytes, err := ioutil.ReadFile(path.Join(dest_dir, name))
+        if err != nil {
+            t.Errorf("couldn't read extracted file %q: %s", name, err)
+            continue
+        }
+        if string(data_bytes) != exp {
+            t.Errorf("%s: got contents %q, expected %q", name,
+                string(data_bytes), exp)
+        }
+    }
+
+    info, err := os.Stat(path.Join(dest_dir, "top/a.txt"))
+    if err != nil {
+        t.Errorf("couldn't stat extracted file: %s", err)
+        return
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("got mode %s, expected %s", info.Mode().Perm(),
+            os.FileMode(0600))
+    }
+    if !info.ModTime().Equal(mtime) {
+        t.Errorf("got mtime %s, expected %s", info.ModTime(), mtime)
+    }
+}
+
+func TestExtractArchiveUnsafe(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    tests := []struct {
+        name string
+        members []tar_member
+        opts fileutil.ExtractOptions
+        expected error
+    }{
+        {"parent dir", []tar_member{
+            {tar.Header{Name: "ok/../../evil.txt"}, "evil\n"}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"backslash path", []tar_member{
+            {tar.Header{Name: "ok\\..\\..\\evil.txt"}, "evil\n"}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"backslash symlink", []tar_member{
+            {tar.Header{Typeflag: tar.TypeSymlink, Name: "link",
+                Linkname: "..\\..\\outside"}, ""}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"absolute path", []tar_member{
+            {tar.Header{Name: "/tmp/evil.txt"}, "evil\n"}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"symlink escape", []tar_member{
+            {tar.Header{Typeflag: tar.TypeSymlink, Name: "a/link",
+                Linkname: "../../outside"}, ""}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"chained symlinks", []tar_member{
+            {tar.Header{Typeflag: tar.TypeDir, Name: "d/"}, ""},
+            {tar.Header{Typeflag: tar.TypeSymlink, Name: "d/l",
+                Linkname: ".."}, ""},
+            {tar.Header{Typeflag: tar.TypeSymlink, Name: "x",
+                Linkname: "d/l/.."}, ""}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"absolute symlink", []tar_member{
+            {tar.Header{Typeflag: tar.TypeSymlink, Name: "link",
+                Linkname: "/etc"}, ""}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"write through symlink", []tar_member{
+            {tar.Header{Typeflag: tar.TypeDir, Name: "dir/"}, ""},
+            {tar.Header{Typeflag: tar.TypeSymlink, Name: "link",
+                Linkname: "dir"}, ""},
+            {tar.Header{Name: "link/file.txt"}, "via link\n"}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"hard link escape", []tar_member{
+            {tar.Header{Typeflag: tar.TypeLink, Name: "hard",
+                Linkname: "../outside"}, ""}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"device", []tar_member{
+            {tar.Header{Typeflag: tar.TypeChar, Name: "null",
+                Devmajor: 1, Devminor: 3}, ""}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"fifo", []tar_member{
+            {tar.Header{Typeflag: tar.TypeFifo, Name: "pipe"}, ""}},
+            fileutil.ExtractOptions{}, fileutil.Err_UnsafeEntry},
+        {"entry count", []tar_member{
+            {tar.Header{Name: "one.txt"}, "1\n"},
+            {tar.Header{Name: "two.txt"}, "2\n"},
+            {tar.Header{Name: "three.txt"}, "3\n"}},
+            fileutil.ExtractOptions{MaxEntries: 2},
+            fileutil.Err_LimitExceeded},
+        {"total size", []tar_member{
+            {tar.Header{Name: "one.txt"}, "0123456789"},
+            {tar.Header{Name: "two.txt"}, "0123456789"}},
+            fileutil.ExtractOptions{MaxTotalSize: 15},
+            fileutil.Err_LimitExceeded},
+        {"within limits", []tar_member{
+            {tar.Header{Name: "one.txt"}, "0123456789"},
+            {tar.Header{Name: "two.txt"}, "0123456789"}},
+            fileutil.ExtractOptions{MaxTotalSize: 20, MaxEntries: 2}, nil},
+    }
+
+    for i, test := range tests {
+        t.Run(test.name, func(st *testing.T) {
+            file := path.Join(out_dir, "test_archive.tar")
+            if err := write_tar(file, test.members); err != nil {
+                st.Errorf("couldn't write archive %q: %s", file, err)
+                return
+            }
+
+            dest_dir := path.Join(out_dir, "dest", string(rune('a' + i)),
+                "inner")
+            err := fileutil.ExtractArchive(file, dest_dir, test.opts)
+            if test.expected == nil {
+                if err != nil {
+                    st.Errorf("couldn't extract %q: %s", file, err)
+                }
+                return
+            }
+            if !errors.Is(err, test.expected) {
+                st.Errorf("got error %v, expected %v", err, test.expected)
+            }
+
+            outside := path.Join(out_dir, "dest", string(rune('a' + i)))
+            if _, err = os.Lstat(path.Join(outside, "evil.txt")); err == nil {
+                st.Errorf("file written outside destination")
+            }
+        })
+    }
+}
+
+func TestExtractZipArchive(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "test_bundle.zip")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+    for _, name := range []string{"docs/report.txt", "../escape.txt"} {
+        w, err := archive.CreateEntry(name, 0644, time.Time{})
+        if err != nil {
+            t.Errorf("couldn't create entry %q: %s", name, err)
+            return
+        }
+        w.Write([]byte(name))
+        w.Close()
+    }
+    if err = archive.Close(); err != nil {
+        t.Errorf("couldn't close archive %q: %s", file, err)
+        return
+    }
+
+    dest_dir := path.Join(out_dir, "dest")
+    err = fileutil.ExtractArchive(file, dest_dir, fileutil.ExtractOptions{})
+    if !errors.Is(err, fileutil.Err_UnsafeEntry) {
+        t.Errorf("got error %v, expected %v", err, fileutil.Err_UnsafeEntry)
+    }
+
+    got, err := read_file(path.Join(dest_dir, "docs/report.txt"))
+    if err != nil {
+        t.Errorf("%s", err)
+        return
+    }
+    if got != "docs/report.txt" {
+        t.Errorf("got contents %q, expected %q", got, "docs/report.txt")
+    }
+    if _, err = os.Lstat(path.Join(out_dir, "escape.txt")); err == nil {
+        t.Errorf("file written outside destination")
+    }
+}
@@ -35,24 +35,31 @@ package fileutil
 import (
     // Built-in/core modules.
     "bufio"
-    "bytes"
-    bzip2 "compress/bzip2"
+    "context"
     "errors"
     exec "os/exec"
     "fmt"
-    gzip "compress/gzip"
     "io"
+    "net/http"
     "os"
+    "path/filepath"
     "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
 
     // Third-party modules.
-
+    dsnet_bzip2 "github.com/dsnet/compress/bzip2"
+    zstd "github.com/klauspost/compress/zstd"
+    xz "github.com/ulikunitz/xz"
 
     // First-party modules.
 )
 
 var (
     Err_UnknownSuffix error = errors.New("Unknown suffix")
+    Err_NotSupported error = errors.New("Operation not supported")
 )
 
 type CloseFunc func() error
@@ -221,56 +228,375 @@ func CreateFileSync(outfile string) (NameWriteCloser, error) {
 //
 // Supported compression:
 //    gzip  (.gz)
-//    bzip2 (.bz2) -- calls external program
-//    xz    (.xz)  -- calls external program
+//    bzip2 (.bz2)
+//    xz    (.xz)  -- calls external program, if available
+//    zstd  (.zst)
+//    zlib  (.zlib, .z)
+//    lzma  (.lzma)
+//
+// Compound suffixes such as ".tgz", ".tbz2", and ".txz" are also recognized.
+// Suffixes are matched without regard to case, except that ".Z" and ".taZ",
+// used by compress(1), aren't taken for zlib or gzip.
+//
+// If `outfile` is "-", output is written to the standard output instead, and
+// the returned NameWriteCloser is named "<stdout>". A compression suffix may
+// be added, e.g., "-.gz" or "-.tar.gz", to compress the standard output. Any
+// other name starting with "-", such as "-.orig", is an ordinary file.
+// Closing the returned NameWriteCloser leaves the process's standard output
+// open.
 //
 // Be sure to call `Close()` explicitly to flush any buffers and properly shut
 // down any compression layers.
 func CreateFileBuffered(outfile string, size int) (NameWriteCloser, error) {
+    return CreateFileWithOptions(outfile, Options{BufferSize: size})
+}
+
+// Options for creating files with `CreateFileWithOptions()`. The zero value
+// gives the same behavior as `CreateFile()`.
+type Options struct {
+    // Size of the output buffer, with the same meaning as the `size`
+    // argument to `CreateFileBuffered()`.
+    BufferSize int
+
+    // Permissions used if the file is created. Defaults to 0666 (before
+    // umask).
+    Mode os.FileMode
+
+    // Fail if the file already exists (O_EXCL).
+    Exclusive bool
+
+    // Append to the file if it already exists instead of truncating it
+    // (O_APPEND).
+    Append bool
+
+    // Compression level for gzip and zlib output, as defined by
+    // compress/gzip. Defaults to gzip.BestCompression, unless
+    // `GzipLevelSet` is true.
+    GzipLevel int
+
+    // Use `GzipLevel` even if it is zero, i.e., gzip.NoCompression.
+    GzipLevelSet bool
+
+    // Number of goroutines used to compress gzip output in-process. If
+    // greater than zero, the output is split into blocks that are compressed
+    // in parallel and written as a single, standard gzip stream. This takes
+    // precedence over the `Parallel` option for gzip output.
+    GzipConcurrency int
+
+    // Size of the blocks compressed in parallel when `GzipConcurrency` is
+    // set. Defaults to 1M.
+    GzipBlockSize int
+
+    // Compression level (1-9) for bzip2 output. Defaults to 9.
+    Bzip2Level int
+
+    // Compression preset (0-9) for xz output. Defaults to 6 in extreme mode,
+    // i.e., `xz -6e`, unless `XzLevelSet` is true. The pure-Go fallback used
+    // when the xz program can't be found has no extreme mode, and uses the
+    // plain preset instead.
+    XzLevel int
+
+    // Use `XzLevel` even if it is zero, i.e., `xz -0`.
+    XzLevelSet bool
+
+    // Compression level for zstd output, using the levels of the zstd
+    // command line program (1-22). Defaults to 3.
+    ZstdLevel int
+
+    // Write to a temporary file in the same directory and only rename it to
+    // the requested name once `Close()` succeeds, so that the file never
+    // appears under its final name partially written. The returned
+    // NameWriteCloser also implements `AbortWriteCloser`. Cannot be combined
+    // with `Append`.
+    Atomic bool
+
+    // Sync the file to stable storage during `Close()`, along with its
+    // parent directory if the file was newly created, so that the file
+    // survives a crash once `Close()` returns without error.
+    Durable bool
+
+    // Compress gzip, bzip2, and xz output with a multi-threaded external
+    // program (pigz, pbzip2, or pixz, or else `xz -T0`) if one can be found.
+    // Otherwise, output is compressed as usual.
+    Parallel bool
+}
+
+// A NameWriteCloser whose output can be discarded instead of committed.
+// Returned by `CreateFileWithOptions()` when the `Atomic` option is set.
+type AbortWriteCloser interface {
+    NameWriteCloser
+
+    // Shuts down any compression layers and removes the temporary file
+    // without renaming it. Calling `Abort()` after `Close()` has no effect.
+    Abort() error
+}
+
+// Opens a file for writing as described by `opts`. If the file name ends in
+// a supported compression suffix, output will be compressed in that format,
+// as with `CreateFileBuffered()`.
+//
+// If `outfile` is "-", output is written to the standard output, as with
+// `CreateFileBuffered()`. Only the buffer size and compression level options
+// apply in that case.
+//
+// Be sure to call `Close()` explicitly to flush any buffers and properly shut
+// down any compression layers.
+func CreateFileWithOptions(
+    outfile string,
+    opts Options,
+) (NameWriteCloser, error) {
+    return CreateFileContext(context.Background(), outfile, opts)
+}
+
+// Like `CreateFileWithOptions()`, but any external programs run for
+// compression are killed if `ctx` is cancelled before `Close()` completes.
+// In that case, `Close()` returns an error wrapping `ctx.Err()`.
+func CreateFileContext(
+    ctx context.Context,
+    outfile string,
+    opts Options,
+) (NameWriteCloser, error) {
+    size := opts.BufferSize
     if size == 0 {
         size = 16384
     }
 
-    out_fh, err := os.Create(outfile)
+    if is_std_stream(outfile) {
+        return create_stdout(ctx, outfile, size, &opts)
+    }
+
+    mode := opts.Mode
+    if mode == 0 {
+        mode = 0666
+    }
+
+    if opts.Atomic && opts.Append {
+        return nil, fmt.Errorf("couldn't open output file %s: " +
+            "the Atomic and Append options are incompatible", outfile)
+    }
+
+    flag := os.O_WRONLY | os.O_CREATE
+    if opts.Append {
+        flag |= os.O_APPEND
+    } else {
+        flag |= os.O_TRUNC
+    }
+    if opts.Exclusive {
+        flag |= os.O_EXCL
+    }
+
+    // A new directory entry must be synced for the file to be durable.
+    sync_parent := false
+    if opts.Durable && !opts.Atomic {
+        _, stat_err := os.Lstat(outfile)
+        sync_parent = os.IsNotExist(stat_err)
+    }
+
+    var out_fh *os.File
+    var err error
+    if opts.Atomic {
+        out_fh, err = create_temp_sibling(outfile, opts.Exclusive, mode)
+    } else {
+        out_fh, err = os.OpenFile(outfile, flag, mode)
+    }
     if err != nil {
         return nil, fmt.Errorf("couldn't open output file %s: %w",
             outfile, err)
     }
 
-    idx := strings.LastIndex(outfile, ".")
-    if idx <= -1 || idx >= len(outfile) - 1 {
-        // No file extension, so no compression layer required.
-        if size > 0 {
-            return NameWriteCloserFromWriteCloser(outfile,
-                add_buffer(out_fh, size)), nil
-        }
-        return out_fh, nil
+    var w io.WriteCloser = out_fh
+    if opts.Atomic || opts.Durable {
+        // For atomic writes, the data must be on disk before the rename
+        // makes it visible.
+        w = WriteCloserFromWriter(out_fh, func() error {
+            if err := out_fh.Sync(); err != nil {
+                out_fh.Close()
+                return fmt.Errorf("couldn't sync %s: %w", outfile, err)
+            }
+            if err := out_fh.Close(); err != nil {
+                return err
+            }
+            if sync_parent {
+                return sync_dir(filepath.Dir(outfile))
+            }
+            return nil
+        })
     }
 
-    suffix := outfile[idx+1:len(outfile)]
-
-    w, err := AddCompressionLayer(out_fh, suffix)
-    if err != nil {
-        if err == Err_UnknownSuffix {
-            // No compression layer added
-            if size > 0 {
-                return NameWriteCloserFromWriteCloser(outfile,
-                    add_buffer(out_fh, size)), nil
+    compress_writer, err := add_compression_layer(ctx, out_fh,
+        file_suffix(outfile), &opts)
+    if err == nil {
+        file_writer := w
+        close_func := func() error {
+            err := compress_writer.Close()
+            if close_err := file_writer.Close(); err == nil {
+                err = close_err
             }
-            return out_fh, nil
-        } else {
-            out_fh.Close()
-            return nil, fmt.Errorf("couldn't add compression layer: %w", err)
+            return err
         }
+        w = WriteCloserFromWriter(compress_writer, close_func)
+    } else if err != Err_UnknownSuffix {
+        out_fh.Close()
+        if opts.Atomic {
+            os.Remove(out_fh.Name())
+        }
+        return nil, fmt.Errorf("couldn't add compression layer: %w", err)
     }
 
     if size > 0 {
         w = add_buffer(w, size)
     }
 
+    if opts.Atomic {
+        return &atomic_writer{
+            name: outfile,
+            tmp_name: out_fh.Name(),
+            wc: w,
+            exclusive: opts.Exclusive,
+            durable: opts.Durable,
+        }, nil
+    }
+
+    if w == io.WriteCloser(out_fh) {
+        return out_fh, nil
+    }
+
     return NameWriteCloserFromWriteCloser(outfile, w), nil
 }
 
+// Sets up output to the standard output, with compression if outfile has a
+// compression suffix. Closing the returned NameWriteCloser shuts down the
+// compression layer without closing the standard output.
+func create_stdout(
+    ctx context.Context,
+    outfile string,
+    size int,
+    opts *Options,
+) (NameWriteCloser, error) {
+    var w io.WriteCloser = WriteCloserFromWriter(os.Stdout, nil)
+
+    compress_writer, err := add_compression_layer(ctx, os.Stdout,
+        file_suffix(outfile), opts)
+    if err == nil {
+        w = compress_writer
+    } else if err != Err_UnknownSuffix {
+        return nil, fmt.Errorf("couldn't add compression layer: %w", err)
+    }
+
+    if size > 0 {
+        w = add_buffer(w, size)
+    }
+
+    return NameWriteCloserFromWriteCloser(stdout_name, w), nil
+}
+
+var temp_file_counter uint32
+
+// Creates a new file in the same directory as outfile to hold output until
+// it is renamed. If exclusive is true, fails if outfile already exists.
+func create_temp_sibling(
+    outfile string,
+    exclusive bool,
+    mode os.FileMode,
+) (*os.File, error) {
+    if exclusive {
+        if _, err := os.Lstat(outfile); err == nil {
+            return nil, &os.PathError{Op: "open", Path: outfile,
+                Err: os.ErrExist}
+        }
+    }
+
+    dir, base := filepath.Split(outfile)
+    for i := 0; i < 10000; i++ {
+        tmp_name := filepath.Join(dir, fmt.Sprintf(".%s.%d.%d.tmp", base,
+            os.Getpid(), atomic.AddUint32(&temp_file_counter, 1)))
+        fh, err := os.OpenFile(tmp_name,
+            os.O_WRONLY | os.O_CREATE | os.O_EXCL, mode)
+        if os.IsExist(err) {
+            continue
+        }
+        return fh, err
+    }
+
+    return nil, fmt.Errorf("couldn't create temporary file for %s", outfile)
+}
+
+// Syncs the directory entries in dir to stable storage.
+func sync_dir(dir string) error {
+    dir_fh, err := os.Open(dir)
+    if err != nil {
+        return fmt.Errorf("couldn't open directory %s for sync: %w", dir, err)
+    }
+
+    err = dir_fh.Sync()
+    dir_fh.Close()
+    if err != nil {
+        return fmt.Errorf("couldn't sync directory %s: %w", dir, err)
+    }
+
+    return nil
+}
+
+type atomic_writer struct {
+    name string
+    tmp_name string
+    wc io.WriteCloser
+    exclusive bool
+    durable bool
+    done bool
+}
+
+func (w *atomic_writer) Name() string {
+    return w.name
+}
+
+func (w *atomic_writer) Write(p []byte) (int, error) {
+    return w.wc.Write(p)
+}
+
+func (w *atomic_writer) Close() error {
+    if w.done {
+        return nil
+    }
+    w.done = true
+
+    if err := w.wc.Close(); err != nil {
+        os.Remove(w.tmp_name)
+        return err
+    }
+
+    if w.exclusive {
+        // Unlike rename, link fails if the target has been created since
+        // the temporary file was opened.
+        err := os.Link(w.tmp_name, w.name)
+        os.Remove(w.tmp_name)
+        if err != nil {
+            return fmt.Errorf("couldn't link %s to %s: %w", w.tmp_name,
+                w.name, err)
+        }
+    } else if err := os.Rename(w.tmp_name, w.name); err != nil {
+        os.Remove(w.tmp_name)
+        return fmt.Errorf("couldn't rename %s to %s: %w", w.tmp_name,
+            w.name, err)
+    }
+
+    if w.durable {
+        return sync_dir(filepath.Dir(w.name))
+    }
+
+    return nil
+}
+
+func (w *atomic_writer) Abort() error {
+    if w.done {
+        return nil
+    }
+    w.done = true
+
+    w.wc.Close()
+    return os.Remove(w.tmp_name)
+}
+
 func add_buffer(w_orig io.WriteCloser, size int) io.WriteCloser {
     w_buffered := bufio.NewWriterSize(w_orig, size)
 
@@ -296,41 +622,379 @@ func add_buffer(w_orig io.WriteCloser, size int) io.WriteCloser {
 // Supported decompression:
 //    gzip  (.gz)
 //    bzip2 (.bz2)
-//    xz    (.xz) -- calls external program
+//    xz    (.xz) -- calls external program, if available
+//    zstd  (.zst)
+//    zlib  (.zlib, .z)
+//    lzma  (.lzma)
+//
+// Compound suffixes such as ".tgz", ".tbz2", and ".txz" are also recognized.
+// Suffixes are matched without regard to case, except that ".Z" and ".taZ",
+// used by compress(1), aren't taken for zlib or gzip. The returned
+// NameReadCloser implements `FormatReadCloser` to report the format used.
+//
+// If `infile` is "-", the standard input is read instead, and the returned
+// NameReadCloser is named "<stdin>". A compression suffix may be added, e.g.,
+// "-.gz" or "-.tar.gz", to decompress the standard input. Any other name
+// starting with "-", such as "-.orig", is an ordinary file.
+//
+// If `infile` is an http:// or https:// URL, the body of a GET request is
+// read, and the returned NameReadCloser is named by the URL. The body is
+// decompressed according to its Content-Encoding header, and then according
+// to the suffix of the URL's path, unless both give the same format. A
+// response other than "200 OK" gives an *HTTPStatusError. See `OpenOptions`
+// for retrying failed transfers.
 //
 // Call `Close()` on the returned NameReadCloser to avoid leaking filehandles
-// and to properly shut down any compression layers.
+// and to properly shut down any compression layers. Closing the standard
+// input this way leaves the process's standard input open.
 func OpenFile(infile string) (NameReadCloser, error) {
-    in_fh, err := os.Open(infile)
+    return OpenFileContext(context.Background(), infile)
+}
+
+// Like `OpenFile()`, but any external programs run for decompression are
+// killed if `ctx` is cancelled before `Close()` completes. In that case,
+// reads fail and `Close()` returns an error wrapping `ctx.Err()`.
+func OpenFileContext(
+    ctx context.Context,
+    infile string,
+) (NameReadCloser, error) {
+    return open_file(ctx, infile, &OpenOptions{})
+}
+
+// Options for reading files with `OpenFileWithOptions()` and
+// `AddDecompressionLayerWithOptions()`. The zero value gives the same
+// behavior as `OpenFile()`. The limits guard against decompression bombs:
+// small inputs that expand to huge amounts of data. Once a limit is
+// exceeded, reads fail with a *DecompressionLimitError.
+type OpenOptions struct {
+    // Maximum number of bytes of decompressed data to return. Zero means no
+    // limit.
+    MaxDecompressedSize int64
+
+    // Maximum ratio of decompressed bytes returned to compressed bytes read,
+    // checked as data is read. Zero means no limit.
+    MaxExpansionRatio float64
+
+    // Client for http:// and https:// URLs. Defaults to
+    // `http.DefaultClient`.
+    HTTPClient *http.Client
+
+    // Number of times to retry a URL after a timeout, a dropped connection,
+    // or a server error status. A transfer that fails part way through is
+    // resumed with a Range request, provided the first response had an ETag
+    // or Last-Modified header, the server supports ranges, and the resource
+    // hasn't changed.
+    HTTPRetries int
+
+    // Time to wait before each retry.
+    HTTPRetryDelay time.Duration
+}
+
+// Like `OpenFile()`, but with the limits in `opts` applied to any
+// decompression layer. Uncompressed files aren't limited.
+func OpenFileWithOptions(
+    infile string,
+    opts OpenOptions,
+) (NameReadCloser, error) {
+    return open_file(context.Background(), infile, &opts)
+}
+
+func open_file(
+    ctx context.Context,
+    infile string,
+    opts *OpenOptions,
+) (NameReadCloser, error) {
+    in_fh, err := open_input(ctx, infile, opts)
     if err != nil {
         return nil, err
     }
 
-    idx := strings.LastIndex(infile, ".")
-    if idx <= -1 || idx >= len(infile) - 1 {
-        return in_fh, nil
+    var src io.Reader = in_fh
+    var enc_reader io.ReadCloser
+    var enc_codec *codec
+    if hr, ok := in_fh.(*http_reader); ok {
+        if enc_codec, err = content_encoding_codec(hr); err != nil {
+            in_fh.Close()
+            return nil, err
+        }
+    }
+    if enc_codec != nil {
+        enc_reader, err = add_codec_reader(ctx, in_fh, enc_codec, opts)
+        if err != nil {
+            in_fh.Close()
+            return nil, fmt.Errorf("couldn't add decompression layer: %w",
+                err)
+        }
+        src = enc_reader
     }
 
-    suffix := infile[idx+1:len(infile)]
-
-    r, err := AddDecompressionLayer(in_fh, suffix)
-    if err != nil {
-        if err == Err_UnknownSuffix {
+    c := lookup_codec(input_suffix(infile))
+    if c == nil || c == enc_codec {
+        if enc_codec == nil {
             return in_fh, nil
-        } else {
+        }
+        c = enc_codec
+    }
+
+    r := enc_reader
+    if c != enc_codec {
+        r, err = add_codec_reader(ctx, src, c, opts)
+        if err != nil {
+            if enc_reader != nil {
+                enc_reader.Close()
+            }
             in_fh.Close()
             return nil, fmt.Errorf("couldn't add decompression layer: %w",
                 err)
         }
     }
 
+    closers := []io.Closer{r}
+    if enc_reader != nil && r != enc_reader {
+        closers = append(closers, enc_reader)
+    }
+    closers = append(closers, in_fh)
+
+    close_func := func() error {
+        return close_all(closers)
+    }
+
+    return &format_read_closer{
+        NameReadCloser: NameReadCloserFromReadCloser(in_fh.Name(),
+            ReadCloserFromReader(r, close_func)),
+        format: c.name,
+    }, nil
+}
+
+// Closes each of closers in order, returning all of the errors.
+func close_all(closers []io.Closer) error {
+    errs := make([]error, 0)
+    for _, c := range closers {
+        if err := c.Close(); err != nil {
+            errs = append(errs, err)
+        }
+    }
+
+    return errors.Join(errs...)
+}
+
+// A NameReadCloser that also reports the compression format of the data
+// being read. `OpenFile()` and `OpenFileAuto()` return a FormatReadCloser
+// whenever they add a decompression layer.
+type FormatReadCloser interface {
+    NameReadCloser
+
+    // Returns the canonical name of the compression format, e.g., "gzip",
+    // regardless of the case or alias used in the file name.
+    Format() string
+}
+
+type format_read_closer struct {
+    NameReadCloser
+    format string
+}
+
+func (r *format_read_closer) Format() string {
+    return r.format
+}
+
+const (
+    stdin_name = "<stdin>"
+    stdout_name = "<stdout>"
+)
+
+// Returns true if name refers to the standard input or output, i.e., it is
+// "-", optionally followed by suffixes ending in a compression suffix, as
+// parsed by `ParsePath()`, such as "-.gz", "-.tgz", or "-.tar.gz". Other
+// names starting with "-.", such as "-.orig", are ordinary files.
+func is_std_stream(name string) bool {
+    if name == "-" {
+        return true
+    }
+    if !strings.HasPrefix(name, "-.") {
+        return false
+    }
+
+    info := ParsePath(name)
+    return info.Base == "-" && info.Compression != ""
+}
+
+// Opens infile for reading, or returns the standard input if infile is "-",
+// or the body of a GET request if it is a URL. Closing the standard input is
+// a no-op.
+func open_input(
+    ctx context.Context,
+    infile string,
+    opts *OpenOptions,
+) (NameReadCloser, error) {
+    if is_url(infile) {
+        return open_url(ctx, infile, opts)
+    }
+
+    if is_std_stream(infile) {
+        return NameReadCloserFromReader(stdin_name, os.Stdin, nil), nil
+    }
+
+    return os.Open(infile)
+}
+
+// Opens a file in read-only mode, detecting the compression format from the
+// magic number at the start of the file rather than trusting the file name.
+// If no known magic number is found, the file name suffix is used instead,
+// as in `OpenFile()`, but only for formats without a magic number, such as
+// zlib.
+//
+// The name of the detected compression format ("gzip", "bzip2", "xz", or
+// "zstd") is returned along with the NameReadCloser. If the file is not
+// compressed, the empty string is returned as the format.
+//
+// No decompression limits are applied; use `OpenFileWithOptions()` for
+// untrusted input.
+//
+// Call `Close()` on the returned NameReadCloser to avoid leaking filehandles
+// and to properly shut down any compression layers.
+func OpenFileAuto(infile string) (NameReadCloser, string, error) {
+    in_fh, err := open_input(context.Background(), infile, &OpenOptions{})
+    if err != nil {
+        return nil, "", err
+    }
+
+    r, format, err := AddDecompressionLayerAuto(in_fh, input_suffix(infile))
+    if err != nil {
+        in_fh.Close()
+        return nil, "", fmt.Errorf("couldn't add decompression layer: %w",
+            err)
+    }
+
     close_func := func() error {
-        r.Close()
-        return in_fh.Close()
+        return close_all([]io.Closer{r, in_fh})
+    }
+
+    rc := NameReadCloserFromReadCloser(in_fh.Name(),
+        ReadCloserFromReader(r, close_func))
+    if format != "" {
+        rc = &format_read_closer{NameReadCloser: rc, format: format}
     }
 
-    return NameReadCloserFromReadCloser(infile,
-        ReadCloserFromReader(r, close_func)), nil
+    return rc, format, nil
+}
+
+// Adds decompression to input read from reader r, detecting the compression
+// format from the magic number at the start of the stream. If no known magic
+// number is found, the suffix is used to pick the format, as in
+// `AddDecompressionLayer()`, but only for formats without a magic number,
+// such as zlib. Otherwise, the input is passed through unchanged, so a plain
+// file named, e.g., "data.gz" is read as is.
+//
+// The name of the detected compression format is returned along with the
+// io.ReadCloser, or the empty string if no decompression was added. Closing
+// the returned io.ReadCloser does not close r. No decompression limits are
+// applied; use `AddDecompressionLayerWithOptions()` for untrusted input.
+func AddDecompressionLayerAuto(
+    r io.Reader,
+    suffix string,
+) (io.ReadCloser, string, error) {
+    buf_reader := bufio.NewReader(r)
+
+    c := detect_codec(buf_reader)
+    if c == nil {
+        // Only trust the suffix for formats that can't be detected, so that,
+        // e.g., a plain text file named "data.gz" is read as is.
+        if suffix_c := lookup_codec(suffix); suffix_c != nil &&
+            suffix_c.detect_len() == 0 {
+            c = suffix_c
+        }
+    }
+    if c == nil {
+        return ReadCloserFromReader(buf_reader, nil), "", nil
+    }
+
+    new_reader, err := add_codec_reader(context.Background(), buf_reader, c,
+        &OpenOptions{})
+    if err != nil {
+        return nil, "", err
+    }
+
+    return new_reader, c.name, nil
+}
+
+// Peeks at the start of the buffered reader br and returns the name of the
+// compression format indicated by its magic number, e.g., "gzip", or the
+// name of a codec added with `RegisterCodec()`. Returns the empty string if
+// no known magic number is found. No data is consumed from br.
+func DetectCompression(br *bufio.Reader) string {
+    if c := detect_codec(br); c != nil {
+        return c.name
+    }
+
+    return ""
+}
+
+// Returns the text after the last dot in name, or the empty string if there
+// is none.
+func file_suffix(name string) string {
+    idx := strings.LastIndex(name, ".")
+    if idx <= -1 || idx >= len(name) - 1 {
+        return ""
+    }
+
+    return name[idx+1:len(name)]
+}
+
+// The parts of a file name, as returned by `ParsePath()`.
+type PathInfo struct {
+    // The file name without its directory or the suffixes below, e.g.,
+    // "events" for "/data/events.csv.gz".
+    Base string
+
+    // The suffix for the format of the data inside any compression, e.g.,
+    // "csv" for "events.csv.gz" or "tar" for "logs.tgz". Empty if there is
+    // none.
+    Format string
+
+    // The name of the compression format, e.g., "gzip" for "events.csv.gz".
+    // Empty if the file name has no supported compression suffix.
+    Compression string
+}
+
+// Splits a file name into its base name, inner format, and compression
+// format, recognizing the same compression suffixes as `OpenFile()` and
+// `CreateFile()`, as well as compound suffixes such as "tgz", "tbz2", and
+// "txz".
+func ParsePath(name string) PathInfo {
+    info := PathInfo{}
+    stem, suffix := split_suffix(filepath.Base(name))
+
+    if compound, ok := compound_suffixes[strings.ToLower(suffix)]; ok &&
+        !compress_suffixes[suffix] {
+        if c := lookup_codec(compound[1]); c != nil {
+            info.Base = stem
+            info.Format = compound[0]
+            info.Compression = c.name
+            return info
+        }
+    }
+
+    if c := lookup_codec(suffix); c != nil {
+        info.Compression = c.name
+        stem, suffix = split_suffix(stem)
+    }
+
+    info.Base = stem
+    info.Format = suffix
+
+    return info
+}
+
+// Splits name into the part before the last dot and the part after it. A
+// leading dot, as in ".profile", doesn't start a suffix.
+func split_suffix(name string) (string, string) {
+    idx := strings.LastIndex(name, ".")
+    if idx <= 0 || idx >= len(name) - 1 {
+        return name, ""
+    }
+
+    return name[:idx], name[idx+1:]
 }
 
 // Adds decompression to input read from reader r, if the suffix is supported.
@@ -338,42 +1002,162 @@ func OpenFile(infile string) (NameReadCloser, error) {
 // Supported decompression:
 //    gzip  (gz)
 //    bzip2 (bz2)
-//    xz    (xz) -- calls external program
+//    xz    (xz) -- calls external program, if available
+//    zstd  (zst, zstd)
+//    zlib  (zlib, z)
+//    lzma  (lzma)
+//
+// The suffix is matched without regard to case.
 func AddDecompressionLayer(
     r io.Reader,
     suffix string,
 ) (io.ReadCloser, error) {
-    switch suffix {
-    case "gz", "gzip":
-        new_reader, err := gzip.NewReader(r)
-        if err != nil {
-            return nil, fmt.Errorf("couldn't create gzip reader: %w", err)
-        }
+    return add_decompression_layer(context.Background(), r, suffix,
+        &OpenOptions{})
+}
 
-        close_func := func() error {
-            return new_reader.Close()
-        }
+// Like `AddDecompressionLayer()`, but with the limits in `opts` applied to
+// the decompressed data.
+func AddDecompressionLayerWithOptions(
+    r io.Reader,
+    suffix string,
+    opts OpenOptions,
+) (io.ReadCloser, error) {
+    return add_decompression_layer(context.Background(), r, suffix, &opts)
+}
+
+func add_decompression_layer(
+    ctx context.Context,
+    r io.Reader,
+    suffix string,
+    opts *OpenOptions,
+) (io.ReadCloser, error) {
+    c := lookup_codec(suffix)
+    if c == nil {
+        return nil, Err_UnknownSuffix
+    }
 
-        return ReadCloserFromReader(new_reader, close_func), nil
+    return add_codec_reader(ctx, r, c, opts)
+}
 
-    case "bz2", "bzip2":
-        new_reader := bzip2.NewReader(r)
-        close_func := func() error { return nil }
-        return ReadCloserFromReader(new_reader, close_func), nil
+func add_codec_reader(
+    ctx context.Context,
+    r io.Reader,
+    c *codec,
+    opts *OpenOptions,
+) (io.ReadCloser, error) {
+    if c.new_reader == nil {
+        return nil, &CodecError{Format: c.name, Op: "decompress",
+            Err: Err_NotSupported}
+    }
+
+    src := &source_reader{r: r}
+    new_reader, err := c.new_reader(ctx, src)
+    if err != nil {
+        return nil, src.codec_error(c.name, "decompress", err)
+    }
+
+    return &codec_reader{format: c.name, rc: new_reader, src: src,
+        opts: *opts}, nil
+}
+
+// Records any error other than io.EOF returned by the underlying reader, so
+// that errors reading the input can be told apart from errors in the
+// compressed data. Also counts the bytes read. External programs read
+// from a goroutine of their own, so the count is updated atomically and the
+// error is guarded by a mutex.
+type source_reader struct {
+    r io.Reader
+    mu sync.Mutex
+    err error
+    n int64
+}
+
+func (r *source_reader) Read(p []byte) (int, error) {
+    n, err := r.r.Read(p)
+    atomic.AddInt64(&r.n, int64(n))
+    if err != nil && err != io.EOF {
+        r.mu.Lock()
+        r.err = err
+        r.mu.Unlock()
+    }
+    return n, err
+}
+
+// Returns err as a *CodecError, unless it came from reading the input.
+func (r *source_reader) codec_error(format, op string, err error) error {
+    r.mu.Lock()
+    src_err := r.err
+    r.mu.Unlock()
+
+    if src_err != nil && errors.Is(err, src_err) {
+        return err
+    }
+
+    return &CodecError{Format: format, Op: op, Err: err}
+}
+
+// A decompression layer that reports errors in the compressed data as
+// *CodecError, and enforces the limits in opts.
+type codec_reader struct {
+    format string
+    rc io.ReadCloser
+    src *source_reader
+    opts OpenOptions
+    out int64
+    limit_err error
+}
+
+func (r *codec_reader) Read(p []byte) (int, error) {
+    if r.limit_err != nil {
+        return 0, r.limit_err
+    }
+
+    n, err := r.rc.Read(p)
+    if err != nil && err != io.EOF {
+        err = r.src.codec_error(r.format, "decompress", err)
+    }
 
-    case "xz":
-        return new_xz_reader(r)
+    compressed := atomic.LoadInt64(&r.src.n)
+    max_size := r.opts.MaxDecompressedSize
+    if max_size > 0 && r.out + int64(n) > max_size {
+        n = int(max_size - r.out)
+        r.out += int64(n)
+        r.limit_err = &DecompressionLimitError{Format: r.format,
+            MaxSize: max_size, Compressed: compressed, Decompressed: r.out}
+        return n, r.limit_err
     }
+    r.out += int64(n)
+
+    max_ratio := r.opts.MaxExpansionRatio
+    if max_ratio > 0 && compressed > 0 &&
+        float64(r.out) / float64(compressed) > max_ratio {
+        r.limit_err = &DecompressionLimitError{Format: r.format,
+            MaxRatio: max_ratio, Compressed: compressed, Decompressed: r.out}
+        return n, r.limit_err
+    }
+
+    return n, err
+}
 
-    return nil, Err_UnknownSuffix
+func (r *codec_reader) Close() error {
+    if err := r.rc.Close(); err != nil {
+        return r.src.codec_error(r.format, "decompress", err)
+    }
+    return nil
 }
 
 // Adds compression to output written to writer w, if the suffix is supported.
 //
 // Supported compression:
 //    gzip  (gz)
-//    bzip2 (bz2) -- calls external program
-//    xz    (xz)  -- calls external program
+//    bzip2 (bz2)
+//    xz    (xz)  -- calls external program, if available
+//    zstd  (zst, zstd)
+//    zlib  (zlib, z)
+//    lzma  (lzma)
+//
+// The suffix is matched without regard to case.
 //
 // Call the Close() method on the returned io.WriteCloser to properly shutdown
 // the compression layer.
@@ -384,38 +1168,51 @@ func AddCompressionLayer(
     io.WriteCloser,
     error,
 ) {
+    return add_compression_layer(context.Background(), w, suffix, &Options{})
+}
 
-    switch suffix {
-    case "gz", "gzip":
-        gzip_writer, err := gzip.NewWriterLevel(w, gzip.BestCompression)
-        if err != nil {
-            return nil, fmt.Errorf("couldn't create gzip writer: %w", err)
-        }
-
-        close_func := func() error {
-            gzip_writer.Flush()
-            return gzip_writer.Close()
-        }
-
-        return WriteCloserFromWriter(gzip_writer, close_func), nil
-
-    case "bz2", "bzip2":
-        return new_bz2_writer(w)
+func add_compression_layer(
+    ctx context.Context,
+    w io.Writer,
+    suffix string,
+    opts *Options,
+) (
+    io.WriteCloser,
+    error,
+) {
+    c := lookup_codec(suffix)
+    if c == nil {
+        return nil, Err_UnknownSuffix
+    }
+    if c.new_writer == nil {
+        return nil, &CodecError{Format: c.name, Op: "compress",
+            Err: Err_NotSupported}
+    }
 
-    case "xz":
-        return new_xz_writer(w)
+    new_writer, err := c.new_writer(ctx, w, opts)
+    if err != nil {
+        return nil, &CodecError{Format: c.name, Op: "compress", Err: err}
     }
 
-    return nil, Err_UnknownSuffix
+    return new_writer, nil
 }
 
-func get_writer_pipe_from_exec_with_writer(prog_stdout io.Writer,
-    prog ...string) (io.WriteCloser, error) {
+// How long to wait, after an external program exits, for its standard
+// output and error to be closed. A program that leaves a child running, as
+// `sh -c "cmd &"` does, may otherwise hold them open indefinitely.
+const exec_wait_delay = 2 * time.Second
+
+func get_writer_pipe_from_exec_with_writer(ctx context.Context,
+    prog_stdout io.Writer, prog ...string) (io.WriteCloser, error) {
 
     name := prog[0]
     args := prog[1:]
-    cmd := exec.Command(name, args...)
+    cmd := exec.CommandContext(ctx, name, args...)
     cmd.Stdout = prog_stdout
+    cmd.WaitDelay = exec_wait_delay
+
+    stderr := &tail_buffer{}
+    cmd.Stderr = stderr
 
     writer_closer, err := cmd.StdinPipe()
     if err != nil {
@@ -427,50 +1224,106 @@ func get_writer_pipe_from_exec_with_writer(prog_stdout io.Writer,
     err = cmd.Start()
     if err != nil {
         writer_closer.Close()
+        if errors.Is(err, exec.ErrNotFound) ||
+            errors.Is(err, os.ErrNotExist) {
+            return nil, &ExecNotFoundError{Name: name, Err: err}
+        }
         return nil, fmt.Errorf("couldn't start process %s: %w",
             strings.Join(prog, " "), err)
     }
 
     close_func := func() error {
         writer_closer.Close()
-        return format_exit_error(cmd.Wait())
+        return wait_for_exit(ctx, cmd, prog, stderr)
     }
 
     return WriteCloserFromWriter(writer_closer, close_func), nil
 }
 
-func format_exit_error(orig_err error) error {
-    if exit_err, ok := orig_err.(*exec.ExitError); ok {
-        errs := make([]string, 0, 2)
-        proc_state := exit_err.ProcessState
-        if proc_state != nil {
-            errs = append(errs, fmt.Sprintf("process exited with code %d: ",
-                proc_state.ExitCode()))
-        }
-        if len(exit_err.Stderr) > 0 {
-            buf := bytes.NewBuffer(exit_err.Stderr)
-            first_line, err := buf.ReadString('\n')
-            if len(first_line) == 0 && err != nil {
-                first_line, _ = buf.ReadString('\n')
-            }
-            errs = append(errs, first_line)
-        }
-        if len(errs) == 0 {
-            return orig_err
+// Waits for cmd to exit and returns any error prefixed by the command line.
+// If the process was killed because ctx was cancelled, the context's error is
+// returned. If the process exited unsuccessfully, an *ExitError is returned
+// that includes the end of its standard error output. If its output is still
+// held open `exec_wait_delay` after it exits, the pipes are closed and an
+// error is returned.
+func wait_for_exit(
+    ctx context.Context,
+    cmd *exec.Cmd,
+    prog []string,
+    stderr *tail_buffer,
+) error {
+    err := cmd.Wait()
+    if err == nil {
+        return nil
+    }
+
+    if ctx.Err() != nil {
+        return fmt.Errorf("%s: %w", strings.Join(prog, " "), ctx.Err())
+    }
+
+    if exit_err, ok := err.(*exec.ExitError); ok {
+        return &ExitError{
+            Command: prog,
+            ExitCode: exit_err.ExitCode(),
+            Stderr: stderr.String(),
+            Err: exit_err,
         }
-        return fmt.Errorf("%s", strings.Join(errs, ": "))
     }
 
-    return orig_err
+    return fmt.Errorf("%s: %w", strings.Join(prog, " "), err)
+}
+
+// Returns true if cmd was killed by SIGPIPE, i.e., it wrote to a pipe whose
+// reading end was closed.
+func killed_by_sigpipe(cmd *exec.Cmd) bool {
+    if cmd.ProcessState == nil {
+        return false
+    }
+
+    status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+    return ok && status.Signaled() && status.Signal() == syscall.SIGPIPE
 }
 
-func get_reader_pipe_from_exec_with_reader(prog_stdin io.Reader,
-    prog ...string) (io.ReadCloser, error) {
+// Maximum number of bytes of standard error kept from external programs.
+const stderr_tail_size = 4096
+
+// An io.Writer that keeps only the last `stderr_tail_size` bytes written to
+// it.
+type tail_buffer struct {
+    buf []byte
+}
+
+func (b *tail_buffer) Write(p []byte) (int, error) {
+    n := len(p)
+    if n >= stderr_tail_size {
+        b.buf = append(b.buf[:0], p[n - stderr_tail_size:]...)
+        return n, nil
+    }
+
+    if overflow := len(b.buf) + n - stderr_tail_size; overflow > 0 {
+        b.buf = append(b.buf[:0], b.buf[overflow:]...)
+    }
+    b.buf = append(b.buf, p...)
+
+    return n, nil
+}
+
+func (b *tail_buffer) String() string {
+    return string(b.buf)
+}
+
+func get_reader_pipe_from_exec_with_reader(ctx context.Context,
+    prog_stdin io.Reader, prog ...string) (io.ReadCloser, error) {
 
     name := prog[0]
     args := prog[1:]
-    cmd := exec.Command(name, args...)
+    cmd := exec.CommandContext(ctx, name, args...)
     cmd.Stdin = prog_stdin
+    cmd.WaitDelay = exec_wait_delay
+
+    stderr := &tail_buffer{}
+    cmd.Stderr = stderr
+
     reader_closer, err := cmd.StdoutPipe()
     if err != nil {
         return nil, fmt.Errorf("couldn't get stdout pipe in prog reader (%s): %w",
@@ -480,57 +1333,246 @@ func get_reader_pipe_from_exec_with_reader(prog_stdin io.Reader,
     err = cmd.Start()
     if err != nil {
         reader_closer.Close()
+        if errors.Is(err, exec.ErrNotFound) ||
+            errors.Is(err, os.ErrNotExist) {
+            return nil, &ExecNotFoundError{Name: name, Err: err}
+        }
         return nil, fmt.Errorf("couldn't start process %s: %w",
             strings.Join(prog, " "), err)
     }
 
-    close_func := func() error {
-        reader_closer.Close()
-        return format_exit_error(cmd.Wait())
+    return &exec_reader{r: reader_closer, ctx: ctx, cmd: cmd, prog: prog,
+        stderr: stderr}, nil
+}
+
+// Reads the standard output of an external program. At the end of the
+// output, the program is waited for, and `Read()` returns its error in place
+// of io.EOF, so that a failed program isn't mistaken for a short result.
+type exec_reader struct {
+    r io.ReadCloser
+    ctx context.Context
+    cmd *exec.Cmd
+    prog []string
+    stderr *tail_buffer
+    wait_once sync.Once
+    wait_err error
+}
+
+func (r *exec_reader) Read(p []byte) (int, error) {
+    n, err := r.r.Read(p)
+    if err == io.EOF {
+        if wait_err := r.wait(); wait_err != nil {
+            return n, wait_err
+        }
     }
 
-    return ReadCloserFromReader(reader_closer, close_func), nil
+    return n, err
 }
 
-func new_bz2_writer(w io.Writer) (io.WriteCloser, error) {
-    path, err := find_exec("bzip2")
-    if err !=  nil {
-        return nil, err
+// Waits for the program once, however many times it is called, and returns
+// its error.
+func (r *exec_reader) wait() error {
+    r.wait_once.Do(func() {
+        r.wait_err = wait_for_exit(r.ctx, r.cmd, r.prog, r.stderr)
+    })
+
+    return r.wait_err
+}
+
+func (r *exec_reader) Close() error {
+    r.r.Close()
+    err := r.wait()
+    if err != nil && r.ctx.Err() == nil && killed_by_sigpipe(r.cmd) {
+        // Closed before all of the output was read.
+        return nil
+    }
+
+    return err
+}
+
+func new_bz2_writer(w io.Writer, level int) (io.WriteCloser, error) {
+    bz2_writer, err := dsnet_bzip2.NewWriter(w,
+        &dsnet_bzip2.WriterConfig{Level: level})
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create bzip2 writer: %w", err)
     }
 
-    return get_writer_pipe_from_exec_with_writer(w, path, "-z", "-c")
+    return bz2_writer, nil
 }
 
-func new_xz_writer(w io.Writer) (io.WriteCloser, error) {
+// Uses the external xz program if it can be found. Otherwise, falls back to
+// the pure-Go implementation.
+func new_xz_writer(
+    ctx context.Context,
+    w io.Writer,
+    level int,
+    extreme bool,
+    threaded bool,
+) (io.WriteCloser, error) {
     xz_path, err := find_exec("xz")
     if err !=  nil {
-        return nil, err
+        return new_xz_writer_native(w, level)
+    }
+
+    args := []string{xz_path, "-z", xz_preset(level, extreme), "-c"}
+    if threaded {
+        args = append(args, "-T0")
     }
 
-    return get_writer_pipe_from_exec_with_writer(w, xz_path, "-z", "-e", "-c")
+    return get_writer_pipe_from_exec_with_writer(ctx, w, args...)
 }
 
-func new_xz_reader(r io.Reader) (io.ReadCloser, error) {
+// Returns the command line flag for the xz preset level, e.g., "-6e" in
+// extreme mode.
+func xz_preset(level int, extreme bool) string {
+    if extreme {
+        return fmt.Sprintf("-%de", level)
+    }
+
+    return fmt.Sprintf("-%d", level)
+}
+
+// Uses the external xz program if it can be found. Otherwise, falls back to
+// the pure-Go implementation.
+func new_xz_reader(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
     xz_path, err := find_exec("xz")
     if err !=  nil {
-        return nil, err
+        return new_xz_reader_native(r)
+    }
+
+    return get_reader_pipe_from_exec_with_reader(ctx, r, xz_path, "-d", "-c")
+}
+
+// Dictionary sizes used by the xz presets 0-9.
+var xz_dict_sizes = []int{
+    256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+    8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+func new_xz_writer_native(w io.Writer, level int) (io.WriteCloser, error) {
+    if level < 0 || level >= len(xz_dict_sizes) {
+        return nil, fmt.Errorf("invalid xz preset: %d", level)
+    }
+
+    config := xz.WriterConfig{DictCap: xz_dict_sizes[level]}
+    xz_writer, err := config.NewWriter(w)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create xz writer: %w", err)
+    }
+
+    return xz_writer, nil
+}
+
+func new_xz_reader_native(r io.Reader) (io.ReadCloser, error) {
+    xz_reader, err := xz.NewReader(r)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create xz reader: %w", err)
+    }
+
+    return ReadCloserFromReader(xz_reader, nil), nil
+}
+
+func new_zstd_writer(w io.Writer, level int) (io.WriteCloser, error) {
+    zstd_opts := []zstd.EOption{}
+    if level > 0 {
+        zstd_opts = append(zstd_opts,
+            zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+    }
+
+    zstd_writer, err := zstd.NewWriter(w, zstd_opts...)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create zstd writer: %w", err)
     }
 
-    return get_reader_pipe_from_exec_with_reader(r, xz_path, "-d", "-c")
+    return zstd_writer, nil
+}
+
+func new_zstd_reader(r io.Reader) (io.ReadCloser, error) {
+    zstd_reader, err := zstd.NewReader(r)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create zstd reader: %w", err)
+    }
+
+    close_func := func() error {
+        zstd_reader.Close()
+        return nil
+    }
+
+    return ReadCloserFromReader(zstd_reader, close_func), nil
+}
+
+var exec_lookup = struct {
+    sync.Mutex
+    overrides map[string]string
+    search_dirs []string
+    cache map[string]string
+}{
+    overrides: map[string]string{},
+    search_dirs: []string{"/bin", "/usr/bin", "/usr/local/bin"},
+    cache: map[string]string{},
+}
+
+// Sets the path used for the external program `name`, e.g., "xz", instead of
+// searching for it. An empty path removes the override.
+func SetExecPath(name, path string) {
+    exec_lookup.Lock()
+    defer exec_lookup.Unlock()
+
+    if path == "" {
+        delete(exec_lookup.overrides, name)
+    } else {
+        exec_lookup.overrides[name] = path
+    }
+    exec_lookup.cache = map[string]string{}
+}
+
+// Sets the directories searched for external programs that aren't found in
+// $PATH. Defaults to /bin, /usr/bin, and /usr/local/bin.
+func SetExecSearchDirs(dirs []string) {
+    exec_lookup.Lock()
+    defer exec_lookup.Unlock()
+
+    exec_lookup.search_dirs = append([]string{}, dirs...)
+    exec_lookup.cache = map[string]string{}
+}
+
+// Returns the path to the external program `name`, as used for bzip2, xz,
+// and external codecs. A path set with `SetExecPath()` is used if there is
+// one. Otherwise, $PATH is searched, followed by the directories set with
+// `SetExecSearchDirs()`. Results are cached, so later changes to $PATH are
+// not seen until `SetExecPath()` or `SetExecSearchDirs()` is called.
+func LookupExec(name string) (string, error) {
+    return find_exec(name)
 }
 
 func find_exec(file string) (string, error) {
-    dirs := []string{"/bin", "/usr/bin", "/usr/local/bin"}
+    exec_lookup.Lock()
+    defer exec_lookup.Unlock()
+
+    if path, ok := exec_lookup.overrides[file]; ok {
+        return path, nil
+    }
 
-    for _, dir := range dirs {
-        path := fmt.Sprintf("%s/%s", dir, file)
+    if path, ok := exec_lookup.cache[file]; ok {
+        return path, nil
+    }
+
+    path, err := exec.LookPath(file)
+    if err == nil && filepath.IsAbs(path) {
+        exec_lookup.cache[file] = path
+        return path, nil
+    }
+
+    for _, dir := range exec_lookup.search_dirs {
+        path := filepath.Join(dir, file)
         _, err := os.Stat(path)
         if err == nil {
+            exec_lookup.cache[file] = path
             return path, nil
         }
     }
 
-    return "", fmt.Errorf("couldn't find executable %s", file)
+    return "", &ExecNotFoundError{Name: file, Err: exec.ErrNotFound}
 }
 
 // Runs the list of commands, piping the output of each one to the next. The
@@ -543,6 +1585,15 @@ func find_exec(file string) (string, error) {
 // the list. Close() should be called when writing has been completed.
 func OpenPipesToWriter(final_writer io.Writer,
     progs [][]string) (io.WriteCloser, error) {
+    return OpenPipesToWriterContext(context.Background(), final_writer,
+        progs)
+}
+
+// Like `OpenPipesToWriter()`, but the programs are killed if `ctx` is
+// cancelled before `Close()` completes. In that case, `Close()` returns an
+// error wrapping `ctx.Err()` that includes the command line.
+func OpenPipesToWriterContext(ctx context.Context, final_writer io.Writer,
+    progs [][]string) (io.WriteCloser, error) {
 
     overall_close_func := func() error { return nil }
     writer := final_writer
@@ -550,19 +1601,20 @@ func OpenPipesToWriter(final_writer io.Writer,
     last := len(progs) - 1
     for i := range progs {
         close_func := overall_close_func
-        prog := progs[last - i]
+        stage := last - i
+        prog := progs[stage]
         new_write_closer, err :=
-            get_writer_pipe_from_exec_with_writer(writer, prog...)
+            get_writer_pipe_from_exec_with_writer(ctx, writer, prog...)
         if err != nil {
             overall_close_func()
-            return nil, err
+            return nil, &PipelineError{Stage: stage, Command: prog, Err: err}
         }
 
         overall_close_func = func() error {
             err1 := new_write_closer.Close()
             err2 := close_func()
             if err1 != nil {
-                return err1
+                return &PipelineError{Stage: stage, Command: prog, Err: err1}
             }
             return err2
         }
@@ -572,3 +1624,59 @@ func OpenPipesToWriter(final_writer io.Writer,
 
     return WriteCloserFromWriter(writer, overall_close_func), nil
 }
+
+// Runs the list of commands, piping the output of each one to the next. The
+// input of the first command is read from src. Each command is represented
+// as a slice of strings, as with `OpenPipesToWriter()`.
+//
+// The reader returned reads from the standard output of the last program in
+// the list. If that program fails, reading ends with its error, e.g., an
+// *ExitError, in place of io.EOF. Close() should be called when reading has
+// been completed. This waits for each program to exit, starting from the
+// last, and returns a *PipelineError for every program that failed.
+func OpenPipesFromReader(src io.Reader,
+    progs [][]string) (io.ReadCloser, error) {
+    return OpenPipesFromReaderContext(context.Background(), src, progs)
+}
+
+// Like `OpenPipesFromReader()`, but the programs are killed if `ctx` is
+// cancelled before `Close()` completes. In that case, `Close()` returns an
+// error wrapping `ctx.Err()` that includes the command line.
+func OpenPipesFromReaderContext(ctx context.Context, src io.Reader,
+    progs [][]string) (io.ReadCloser, error) {
+
+    closers := make([]io.ReadCloser, 0, len(progs))
+    overall_close_func := func() error {
+        errs := make([]error, 0)
+        for i := len(closers) - 1; i >= 0; i-- {
+            if err := closers[i].Close(); err != nil {
+                errs = append(errs,
+                    &PipelineError{Stage: i, Command: progs[i], Err: err})
+            }
+        }
+        return errors.Join(errs...)
+    }
+
+    reader := src
+    for stage, prog := range progs {
+        new_read_closer, err :=
+            get_reader_pipe_from_exec_with_reader(ctx, reader, prog...)
+        if err != nil {
+            overall_close_func()
+            return nil, &PipelineError{Stage: stage, Command: prog, Err: err}
+        }
+
+        closers = append(closers, new_read_closer)
+
+        if stage < len(progs) - 1 {
+            // The next program reads the pipe directly, so that it sees only
+            // the end of the output, and not this program's exit status,
+            // which is reported by Close().
+            reader = new_read_closer.(*exec_reader).r
+        } else {
+            reader = new_read_closer
+        }
+    }
+
+    return ReadCloserFromReader(reader, overall_close_func), nil
+}
@@ -2,12 +2,19 @@ package fileutil_test
 
 import (
     // Built-in/core modules.
+    "bytes"
+    gzip "compress/gzip"
+    "context"
+    "crypto/rand"
+    "errors"
     "fmt"
     ioutil "io/ioutil"
     "os"
+    "os/exec"
     "path"
     "strings"
     "testing"
+    "time"
 
     // Third-party modules.
 
@@ -27,18 +34,21 @@ func TestFileCreation(t *testing.T) {
         {"bzip2", ".bz2", "BZh", 0},
         {"gzip", ".gz", "\x1F\x8B", 0},
         {"xz", ".xz", "\xFD\x37\x7A\x58\x5A\x00", 0},
+        {"zstd", ".zst", "\x28\xB5\x2F\xFD", 0},
         {"plain", ".txt", "", 0},
 
         // no buffer (synchronous)
         {"bzip2", ".bz2", "BZh", -1},
         {"gzip", ".gz", "\x1F\x8B", -1},
         {"xz", ".xz", "\xFD\x37\x7A\x58\x5A\x00", -1},
+        {"zstd", ".zst", "\x28\xB5\x2F\xFD", -1},
         {"plain", ".txt", "", -1},
 
         // custom buffer size
         {"bzip2", ".bz2", "BZh", 32},
         {"gzip", ".gz", "\x1F\x8B", 32},
         {"xz", ".xz", "\xFD\x37\x7A\x58\x5A\x00", 32},
+        {"zstd", ".zst", "\x28\xB5\x2F\xFD", 32},
         {"plain", ".txt", "", 32},
     }
 
@@ -188,3 +198,1432 @@ func TestPipesWriter(t *testing.T) {
         return
     }
 }
+
+func TestOpenFileAuto(t *testing.T) {
+    tests := []struct {
+        Name string
+        CreateSuffix string
+        OpenSuffix string
+        Format string
+    }{
+        {"gzip_as_log", ".gz", ".log", "gzip"},
+        {"bzip2_as_gz", ".bz2", ".gz", "bzip2"},
+        {"xz_no_suffix", ".xz", "", "xz"},
+        {"zstd_as_txt", ".zst", ".txt", "zstd"},
+        {"lzma_as_dat", ".lzma", ".dat", "lzma"},
+        {"zlib_by_suffix", ".zlib", ".zlib", "zlib"},
+        {"plain", ".txt", ".txt", ""},
+        {"empty", ".txt", ".dat", ""},
+    }
+
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    for _, test := range tests {
+        t.Run(test.Name, func(st *testing.T) {
+            test_str := "one\ntwo\nthree\n"
+            if test.Name == "empty" {
+                test_str = ""
+            }
+
+            file := path.Join(out_dir, test.Name + test.CreateSuffix)
+            out_fh, err := fileutil.CreateFile(file)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            fmt.Fprintf(out_fh, "%s", test_str)
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            renamed := path.Join(out_dir, test.Name + "_renamed" +
+                test.OpenSuffix)
+            if err = os.Rename(file, renamed); err != nil {
+                st.Errorf("couldn't rename %q: %s", file, err)
+                return
+            }
+
+            in, format, err := fileutil.OpenFileAuto(renamed)
+            if err != nil {
+                st.Errorf("couldn't open file %q for input: %s", renamed, err)
+                return
+            }
+            defer in.Close()
+
+            if format != test.Format {
+                st.Errorf("got format %q, expected %q", format, test.Format)
+            }
+
+            if in.Name() != renamed {
+                st.Errorf("got name %q, expected %q", in.Name(), renamed)
+            }
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err != nil {
+                st.Errorf("couldn't read all from file %q: %s", renamed, err)
+                return
+            }
+
+            if string(data_bytes) != test_str {
+                st.Errorf("file contents incorrect: got %q, expected %q",
+                    string(data_bytes), test_str)
+            }
+        })
+    }
+}
+
+func TestOpenFileAutoPlain(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Plain files that start like a compressed one.
+    tests := map[string]string{
+        "bzip2_word.dat": "BZhello, world\n",
+        "bzip2_level_0.dat": "BZh0 is not a block size\n",
+        "lzma_like.dat": "\x5D\x00\x00 is not an lzma dictionary size\n",
+        "lzma_short.dat": "\x5D\x00\x00\x80\x00",
+
+        // Plain text named like a compressed file.
+        "plain_text.gz": "hello, world\n",
+        "plain_text.xz": "hello, world\n",
+    }
+
+    for name, test_str := range tests {
+        t.Run(name, func(st *testing.T) {
+            file := path.Join(out_dir, name)
+            err := ioutil.WriteFile(file, []byte(test_str), 0644)
+            if err != nil {
+                st.Errorf("couldn't write %q: %s", file, err)
+                return
+            }
+
+            in, format, err := fileutil.OpenFileAuto(file)
+            if err != nil {
+                st.Errorf("couldn't open file %q for input: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            if format != "" {
+                st.Errorf("got format %q, expected none", format)
+            }
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err != nil {
+                st.Errorf("couldn't read all from file %q: %s", file, err)
+                return
+            }
+            if string(data_bytes) != test_str {
+                st.Errorf("file contents incorrect: got %q, expected %q",
+                    string(data_bytes), test_str)
+            }
+        })
+    }
+}
+
+func TestCreateFileWithOptions(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "opts_out.gz")
+    opts := fileutil.Options{
+        Mode: 0600,
+        Exclusive: true,
+        GzipLevel: 1,
+    }
+
+    out_fh, err := fileutil.CreateFileWithOptions(file, opts)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    fmt.Fprintf(out_fh, "%s", "first\n")
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    info, err := os.Stat(file)
+    if err != nil {
+        t.Errorf("couldn't stat %q: %s", file, err)
+        return
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("got mode %o, expected %o", info.Mode().Perm(), 0600)
+    }
+
+    _, err = fileutil.CreateFileWithOptions(file, opts)
+    if !os.IsExist(errors.Unwrap(err)) {
+        t.Errorf("expected file exists error with Exclusive, got %v", err)
+    }
+
+    // Concatenated gzip members read back as a single stream.
+    opts = fileutil.Options{Append: true, GzipLevel: gzip.BestSpeed}
+    out_fh, err = fileutil.CreateFileWithOptions(file, opts)
+    if err != nil {
+        t.Errorf("couldn't open output file %q for append: %s", file, err)
+        return
+    }
+    fmt.Fprintf(out_fh, "%s", "second\n")
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    in, err := fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open file %q for input: %s", file, err)
+        return
+    }
+    defer in.Close()
+
+    data_bytes, err := ioutil.ReadAll(in)
+    if err != nil {
+        t.Errorf("couldn't read all from file %q: %s", file, err)
+        return
+    }
+
+    expected := "first\nsecond\n"
+    if string(data_bytes) != expected {
+        t.Errorf("file contents incorrect: got %q, expected %q",
+            string(data_bytes), expected)
+    }
+}
+
+func TestCreateFileAtomic(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "atomic_out.gz")
+    opts := fileutil.Options{Atomic: true}
+
+    out_fh, err := fileutil.CreateFileWithOptions(file, opts)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    if out_fh.Name() != file {
+        t.Errorf("got name %q, expected %q", out_fh.Name(), file)
+    }
+
+    fmt.Fprintf(out_fh, "%s", "atomic\n")
+    if _, err = os.Stat(file); !os.IsNotExist(err) {
+        t.Errorf("file %q visible before Close(): %v", file, err)
+    }
+
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    in, err := fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open file %q for input: %s", file, err)
+        return
+    }
+    data_bytes, err := ioutil.ReadAll(in)
+    in.Close()
+    if err != nil {
+        t.Errorf("couldn't read all from file %q: %s", file, err)
+        return
+    }
+    if string(data_bytes) != "atomic\n" {
+        t.Errorf("file contents incorrect: got %q, expected %q",
+            string(data_bytes), "atomic\n")
+    }
+
+    aborted := path.Join(out_dir, "aborted.txt")
+    out_fh, err = fileutil.CreateFileWithOptions(aborted, opts)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", aborted, err)
+        return
+    }
+    fmt.Fprintf(out_fh, "%s", "discarded\n")
+
+    abort_fh, ok := out_fh.(fileutil.AbortWriteCloser)
+    if !ok {
+        t.Errorf("atomic writer does not implement AbortWriteCloser")
+        return
+    }
+    if err = abort_fh.Abort(); err != nil {
+        t.Errorf("couldn't abort output file %q: %s", aborted, err)
+    }
+
+    if _, err = os.Stat(aborted); !os.IsNotExist(err) {
+        t.Errorf("file %q exists after Abort(): %v", aborted, err)
+    }
+
+    entries, err := ioutil.ReadDir(out_dir)
+    if err != nil {
+        t.Errorf("couldn't read directory %q: %s", out_dir, err)
+        return
+    }
+    if len(entries) != 1 {
+        t.Errorf("expected only %q in %q, found %d entries", file, out_dir,
+            len(entries))
+    }
+}
+
+func TestCreateFileDurable(t *testing.T) {
+    tests := []struct {
+        Name string
+        Suffix string
+        Atomic bool
+        BufSize int
+    }{
+        {"plain", ".txt", false, 0},
+        {"plain_sync", ".txt", false, -1},
+        {"gzip", ".gz", false, 0},
+        {"gzip_atomic", ".gz", true, 0},
+        {"plain_atomic", ".txt", true, -1},
+    }
+
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    for _, test := range tests {
+        t.Run(test.Name, func(st *testing.T) {
+            file := path.Join(out_dir, test.Name + test.Suffix)
+            opts := fileutil.Options{
+                Durable: true,
+                Atomic: test.Atomic,
+                BufferSize: test.BufSize,
+            }
+
+            out_fh, err := fileutil.CreateFileWithOptions(file, opts)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            fmt.Fprintf(out_fh, "%s", "durable\n")
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            in, err := fileutil.OpenFile(file)
+            if err != nil {
+                st.Errorf("couldn't open file %q for input: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err != nil {
+                st.Errorf("couldn't read all from file %q: %s", file, err)
+                return
+            }
+            if string(data_bytes) != "durable\n" {
+                st.Errorf("file contents incorrect: got %q, expected %q",
+                    string(data_bytes), "durable\n")
+            }
+        })
+    }
+}
+
+func TestStdStreams(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    orig_stdin := os.Stdin
+    orig_stdout := os.Stdout
+    defer func() {
+        os.Stdin = orig_stdin
+        os.Stdout = orig_stdout
+    }()
+
+    file := path.Join(out_dir, "stdout.gz")
+    stdout_fh, err := os.Create(file)
+    if err != nil {
+        t.Errorf("couldn't create test file %q: %s", file, err)
+        return
+    }
+    defer stdout_fh.Close()
+    os.Stdout = stdout_fh
+
+    out_fh, err := fileutil.CreateFile("-.gz")
+    if err != nil {
+        t.Errorf("couldn't open standard output: %s", err)
+        return
+    }
+    if out_fh.Name() != "<stdout>" {
+        t.Errorf("got name %q, expected %q", out_fh.Name(), "<stdout>")
+    }
+    fmt.Fprintf(out_fh, "%s", "standard\n")
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close standard output: %s", err)
+        return
+    }
+
+    // The standard output should still be open.
+    if _, err = stdout_fh.Seek(0, 0); err != nil {
+        t.Errorf("standard output closed by Close(): %s", err)
+        return
+    }
+    os.Stdin = stdout_fh
+
+    in, err := fileutil.OpenFile("-.gz")
+    if err != nil {
+        t.Errorf("couldn't open standard input: %s", err)
+        return
+    }
+    if in.Name() != "<stdin>" {
+        t.Errorf("got name %q, expected %q", in.Name(), "<stdin>")
+    }
+
+    data_bytes, err := ioutil.ReadAll(in)
+    if err != nil {
+        t.Errorf("couldn't read all from standard input: %s", err)
+        return
+    }
+    if string(data_bytes) != "standard\n" {
+        t.Errorf("contents incorrect: got %q, expected %q",
+            string(data_bytes), "standard\n")
+    }
+
+    if err = in.Close(); err != nil {
+        t.Errorf("couldn't close standard input: %s", err)
+    }
+    if _, err = stdout_fh.Seek(0, 0); err != nil {
+        t.Errorf("standard input closed by Close(): %s", err)
+    }
+}
+
+func TestStdStreamNames(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    orig_dir, err := os.Getwd()
+    if err != nil {
+        t.Errorf("couldn't get working directory: %s", err)
+        return
+    }
+    if err = os.Chdir(out_dir); err != nil {
+        t.Errorf("couldn't change to %q: %s", out_dir, err)
+        return
+    }
+    defer os.Chdir(orig_dir)
+
+    // Only compression suffixes after "-" mean a standard stream.
+    for _, name := range []string{"-.orig", "-.txt.bak", "-.gz.bak"} {
+        out_fh, err := fileutil.CreateFile(name)
+        if err != nil {
+            t.Errorf("couldn't create %q: %s", name, err)
+            return
+        }
+        if out_fh.Name() != name {
+            t.Errorf("got name %q, expected %q", out_fh.Name(), name)
+        }
+        fmt.Fprintf(out_fh, "%s", "not standard\n")
+        if err = out_fh.Close(); err != nil {
+            t.Errorf("couldn't close %q: %s", name, err)
+            return
+        }
+
+        got, err := read_file(path.Join(out_dir, name))
+        if err != nil {
+            t.Errorf("%s", err)
+            return
+        }
+        if got != "not standard\n" {
+            t.Errorf("contents of %q incorrect: got %q, expected %q", name,
+                got, "not standard\n")
+        }
+    }
+
+    orig_stdout := os.Stdout
+    defer func() {
+        os.Stdout = orig_stdout
+    }()
+
+    stdout_file := path.Join(out_dir, "stdout")
+    stdout_fh, err := os.Create(stdout_file)
+    if err != nil {
+        t.Errorf("couldn't create test file %q: %s", stdout_file, err)
+        return
+    }
+    defer stdout_fh.Close()
+    os.Stdout = stdout_fh
+
+    for _, name := range []string{"-.tgz", "-.tar.gz", "-.TAR.XZ"} {
+        out_fh, err := fileutil.CreateFile(name)
+        if err != nil {
+            t.Errorf("couldn't open %q: %s", name, err)
+            return
+        }
+        if out_fh.Name() != "<stdout>" {
+            t.Errorf("got name %q for %q, expected %q", out_fh.Name(), name,
+                "<stdout>")
+        }
+        if err = out_fh.Close(); err != nil {
+            t.Errorf("couldn't close %q: %s", name, err)
+        }
+        if _, err = os.Stat(path.Join(out_dir, name)); err == nil {
+            t.Errorf("%q was created as a file", name)
+        }
+    }
+}
+
+func TestPipesReader(t *testing.T) {
+    cmds := [][]string{
+        []string{"cut", "-f2-"},
+        []string{"sort"},
+    }
+
+    input_str := "2\ttwo\n3\tthree\n1\tone\n"
+    expected_output := "one\nthree\ntwo\n"
+
+    rc, err := fileutil.OpenPipesFromReader(strings.NewReader(input_str),
+        cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesFromReader: %s", err)
+        return
+    }
+
+    got_bytes, err := ioutil.ReadAll(rc)
+    if err != nil {
+        t.Errorf("failed to ReadAll from pipes reader: %s", err)
+        rc.Close()
+        return
+    }
+
+    if err = rc.Close(); err != nil {
+        t.Errorf("close on pipes reader failed: %s", err)
+        return
+    }
+
+    if string(got_bytes) != expected_output {
+        t.Errorf("got %q, expected %q", string(got_bytes), expected_output)
+        return
+    }
+
+    cmds = [][]string{
+        []string{"sh", "-c", "cat; exit 3"},
+        []string{"sh", "-c", "cat; exit 4"},
+    }
+
+    rc, err = fileutil.OpenPipesFromReader(strings.NewReader(input_str),
+        cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesFromReader: %s", err)
+        return
+    }
+    ioutil.ReadAll(rc)
+
+    err = rc.Close()
+    if err == nil {
+        t.Errorf("expected error from failing pipeline")
+        return
+    }
+    for _, code := range []string{"code 3", "code 4"} {
+        if !strings.Contains(err.Error(), code) {
+            t.Errorf("error %q doesn't mention %q", err, code)
+        }
+    }
+}
+
+func TestPipesContext(t *testing.T) {
+    ctx, cancel := context.WithTimeout(context.Background(),
+        100 * time.Millisecond)
+    defer cancel()
+
+    var out bytes.Buffer
+    cmds := [][]string{
+        []string{"sleep", "10"},
+    }
+
+    wc, err := fileutil.OpenPipesToWriterContext(ctx, &out, cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesToWriterContext: %s", err)
+        return
+    }
+
+    start := time.Now()
+    err = wc.Close()
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("expected deadline exceeded error, got %v", err)
+    }
+    if err != nil && !strings.Contains(err.Error(), "sleep 10") {
+        t.Errorf("error %q doesn't include the command line", err)
+    }
+    if elapsed := time.Since(start); elapsed > 5 * time.Second {
+        t.Errorf("Close() took %s after cancellation", elapsed)
+    }
+
+    cancel_ctx, cancel_func := context.WithCancel(context.Background())
+    defer cancel_func()
+
+    rc, err := fileutil.OpenPipesFromReaderContext(cancel_ctx,
+        strings.NewReader(""), cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesFromReaderContext: %s", err)
+        return
+    }
+    cancel_func()
+
+    ioutil.ReadAll(rc)
+    err = rc.Close()
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("expected canceled error, got %v", err)
+    }
+}
+
+func TestOpenFileContext(t *testing.T) {
+    if _, err := fileutil.LookupExec("xz"); err != nil {
+        t.Skipf("xz not found: %s", err)
+    }
+
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Random data doesn't compress, so xz can't finish before the context
+    // is cancelled.
+    data := make([]byte, 1200000)
+    rand.Read(data)
+    file := path.Join(out_dir, "test_context.xz")
+    out_fh, err := fileutil.CreateFile(file)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    out_fh.Write(data)
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    in, err := fileutil.OpenFileContext(ctx, file)
+    if err != nil {
+        t.Errorf("couldn't open file %q for input: %s", file, err)
+        return
+    }
+
+    buf := make([]byte, 4096)
+    if _, err = in.Read(buf); err != nil {
+        t.Errorf("couldn't read from %q: %s", file, err)
+    }
+    cancel()
+
+    if _, err = ioutil.ReadAll(in); !errors.Is(err, context.Canceled) {
+        t.Errorf("expected canceled error from Read(), got %v", err)
+    }
+    if err = in.Close(); !errors.Is(err, context.Canceled) {
+        t.Errorf("expected canceled error from Close(), got %v", err)
+    }
+
+    // Closing early without cancelling isn't an error.
+    in, err = fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open file %q for input: %s", file, err)
+        return
+    }
+    if _, err = in.Read(buf); err != nil {
+        t.Errorf("couldn't read from %q: %s", file, err)
+    }
+    if err = in.Close(); err != nil {
+        t.Errorf("got error closing %q early: %s", file, err)
+    }
+}
+
+func TestOpenFileTruncated(t *testing.T) {
+    if _, err := fileutil.LookupExec("xz"); err != nil {
+        t.Skipf("xz not found: %s", err)
+    }
+
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    data := make([]byte, 1200000)
+    rand.Read(data)
+    file := path.Join(out_dir, "test_truncated.xz")
+    out_fh, err := fileutil.CreateFile(file)
+    if err != nil {
+        t.Errorf("couldn't open output file %q: %s", file, err)
+        return
+    }
+    out_fh.Write(data)
+    if err = out_fh.Close(); err != nil {
+        t.Errorf("couldn't close output file %q: %s", file, err)
+        return
+    }
+
+    info, err := os.Stat(file)
+    if err != nil {
+        t.Errorf("couldn't stat %q: %s", file, err)
+        return
+    }
+    if err = os.Truncate(file, info.Size() / 2); err != nil {
+        t.Errorf("couldn't truncate %q: %s", file, err)
+        return
+    }
+
+    in, err := fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open file %q for input: %s", file, err)
+        return
+    }
+
+    got, err := ioutil.ReadAll(in)
+    exit_err := &fileutil.ExitError{}
+    if !errors.As(err, &exit_err) {
+        t.Errorf("expected *ExitError after %d bytes, got %v", len(got), err)
+    }
+    if err = in.Close(); !errors.As(err, &exit_err) {
+        t.Errorf("expected *ExitError from Close(), got %v", err)
+    }
+
+    // The same goes for programs run directly.
+    cmds := [][]string{
+        []string{"sh", "-c", "echo partial; exit 3"},
+    }
+    rc, err := fileutil.OpenPipesFromReader(strings.NewReader(""), cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesFromReader: %s", err)
+        return
+    }
+
+    got, err = ioutil.ReadAll(rc)
+    if !errors.As(err, &exit_err) || exit_err.ExitCode != 3 {
+        t.Errorf("expected *ExitError with code 3, got %v", err)
+    }
+    if string(got) != "partial\n" {
+        t.Errorf("got %q, expected %q", string(got), "partial\n")
+    }
+    rc.Close()
+}
+
+func TestPipesBackgroundChild(t *testing.T) {
+    // The background sleep keeps the shell's output open after it exits.
+    cmds := [][]string{
+        []string{"sh", "-c", "cat; sleep 10 &"},
+    }
+
+    var out bytes.Buffer
+    wc, err := fileutil.OpenPipesToWriter(&out, cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesToWriter: %s", err)
+        return
+    }
+
+    fmt.Fprintf(wc, "hello\n")
+    start := time.Now()
+    err = wc.Close()
+    if elapsed := time.Since(start); elapsed > 8 * time.Second {
+        t.Errorf("Close() took %s with a background child", elapsed)
+    }
+    if !errors.Is(err, exec.ErrWaitDelay) {
+        t.Errorf("expected exec.ErrWaitDelay, got %v", err)
+    }
+    if out.String() != "hello\n" {
+        t.Errorf("got %q, expected %q", out.String(), "hello\n")
+    }
+
+    cmds = [][]string{
+        []string{"sh", "-c", "sleep 10 > /dev/null & cat"},
+    }
+    rc, err := fileutil.OpenPipesFromReader(strings.NewReader("hello\n"),
+        cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesFromReader: %s", err)
+        return
+    }
+
+    got, _ := ioutil.ReadAll(rc)
+    start = time.Now()
+    err = rc.Close()
+    if elapsed := time.Since(start); elapsed > 8 * time.Second {
+        t.Errorf("Close() took %s with a background child", elapsed)
+    }
+    if !errors.Is(err, exec.ErrWaitDelay) {
+        t.Errorf("expected exec.ErrWaitDelay, got %v", err)
+    }
+    if string(got) != "hello\n" {
+        t.Errorf("got %q, expected %q", string(got), "hello\n")
+    }
+}
+
+func TestPipesStderr(t *testing.T) {
+    cmds := [][]string{
+        []string{"sh", "-c",
+            "head -c 10000 /dev/zero | tr '\\0' x >&2; " +
+            "echo >&2; echo 'something broke' >&2; exit 2"},
+    }
+
+    var out bytes.Buffer
+    wc, err := fileutil.OpenPipesToWriter(&out, cmds)
+    if err != nil {
+        t.Errorf("couldn't OpenPipesToWriter: %s", err)
+        return
+    }
+
+    err = wc.Close()
+    exit_err := &fileutil.ExitError{}
+    if !errors.As(err, &exit_err) {
+        t.Errorf("expected *ExitError, got %v", err)
+        return
+    }
+
+    if exit_err.ExitCode != 2 {
+        t.Errorf("got exit code %d, expected 2", exit_err.ExitCode)
+    }
+    if exit_err.Command[0] != "sh" {
+        t.Errorf("got command %q, expected sh", exit_err.Command)
+    }
+    if len(exit_err.Stderr) > 4096 {
+        t.Errorf("stderr not bounded: got %d bytes", len(exit_err.Stderr))
+    }
+    if !strings.HasSuffix(exit_err.Stderr, "something broke\n") {
+        t.Errorf("stderr tail missing message: %q", exit_err.Stderr)
+    }
+    if !strings.Contains(err.Error(), "code 2: something broke") {
+        t.Errorf("error message %q doesn't include stderr", err)
+    }
+}
+
+func TestExecLookup(t *testing.T) {
+    tool := "fileutil_test_tool"
+
+    fileutil.SetExecPath(tool, "/custom/bin/" + tool)
+    found, err := fileutil.LookupExec(tool)
+    if err != nil || found != "/custom/bin/" + tool {
+        t.Errorf("got %q, %v, expected override", found, err)
+    }
+
+    fileutil.SetExecPath(tool, "")
+    _, err = fileutil.LookupExec(tool)
+    not_found_err := &fileutil.ExecNotFoundError{}
+    if !errors.As(err, &not_found_err) {
+        t.Errorf("expected *ExecNotFoundError, got %v", err)
+    }
+
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    tool_path := path.Join(out_dir, tool)
+    err = ioutil.WriteFile(tool_path, []byte("#!/bin/sh\n"), 0755)
+    if err != nil {
+        t.Errorf("couldn't write %q: %s", tool_path, err)
+        return
+    }
+
+    fileutil.SetExecSearchDirs([]string{out_dir})
+    defer fileutil.SetExecSearchDirs(
+        []string{"/bin", "/usr/bin", "/usr/local/bin"})
+
+    found, err = fileutil.LookupExec(tool)
+    if err != nil || found != tool_path {
+        t.Errorf("got %q, %v, expected %q", found, err, tool_path)
+    }
+
+    // Programs in $PATH are found without configuration.
+    if _, err = fileutil.LookupExec("sh"); err != nil {
+        t.Errorf("couldn't find sh: %s", err)
+    }
+}
+
+func TestCreateFileParallel(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Stand-in for pigz that records that it was run.
+    marker := path.Join(out_dir, "pigz_ran")
+    fake_pigz := path.Join(out_dir, "pigz")
+    script := fmt.Sprintf("#!/bin/sh\ntouch %s\nexec gzip \"$@\"\n", marker)
+    if err = ioutil.WriteFile(fake_pigz, []byte(script), 0755); err != nil {
+        t.Errorf("couldn't write %q: %s", fake_pigz, err)
+        return
+    }
+    fileutil.SetExecPath("pigz", fake_pigz)
+    defer fileutil.SetExecPath("pigz", "")
+
+    tests := []struct {
+        Name string
+        Suffix string
+    }{
+        {"gzip", ".gz"},
+        {"bzip2", ".bz2"},
+        {"xz", ".xz"},
+        {"zstd", ".zst"},
+    }
+
+    test_str := strings.Repeat("compressed in parallel\n", 100)
+    for _, test := range tests {
+        t.Run(test.Name, func(st *testing.T) {
+            file := path.Join(out_dir, "parallel_out" + test.Suffix)
+            opts := fileutil.Options{Parallel: true}
+
+            out_fh, err := fileutil.CreateFileWithOptions(file, opts)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            fmt.Fprintf(out_fh, "%s", test_str)
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            in, err := fileutil.OpenFile(file)
+            if err != nil {
+                st.Errorf("couldn't open file %q for input: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err != nil {
+                st.Errorf("couldn't read all from file %q: %s", file, err)
+                return
+            }
+            if string(data_bytes) != test_str {
+                st.Errorf("file contents incorrect for %q", file)
+            }
+        })
+    }
+
+    if _, err = os.Stat(marker); err != nil {
+        t.Errorf("pigz wasn't used for gzip output: %s", err)
+    }
+}
+
+func TestParsePath(t *testing.T) {
+    tests := []struct {
+        Path string
+        Expected fileutil.PathInfo
+    }{
+        {"events.csv.gz", fileutil.PathInfo{"events", "csv", "gzip"}},
+        {"/data/events.csv.gz", fileutil.PathInfo{"events", "csv", "gzip"}},
+        {"logs.tar.gz", fileutil.PathInfo{"logs", "tar", "gzip"}},
+        {"logs.tgz", fileutil.PathInfo{"logs", "tar", "gzip"}},
+        {"logs.tbz2", fileutil.PathInfo{"logs", "tar", "bzip2"}},
+        {"logs.txz", fileutil.PathInfo{"logs", "tar", "xz"}},
+        {"data.zst", fileutil.PathInfo{"data", "", "zstd"}},
+        {"report.csv", fileutil.PathInfo{"report", "csv", ""}},
+        {"README", fileutil.PathInfo{"README", "", ""}},
+        {".profile", fileutil.PathInfo{".profile", "", ""}},
+        {"a.b.c.xz", fileutil.PathInfo{"a.b", "c", "xz"}},
+        {"logs.taz", fileutil.PathInfo{"logs", "tar", "gzip"}},
+        {"old.Z", fileutil.PathInfo{"old", "Z", ""}},
+        {"logs.taZ", fileutil.PathInfo{"logs", "taZ", ""}},
+        {"data.z", fileutil.PathInfo{"data", "", "zlib"}},
+    }
+
+    for _, test := range tests {
+        got := fileutil.ParsePath(test.Path)
+        if got != test.Expected {
+            t.Errorf("ParsePath(%q): got %+v, expected %+v", test.Path, got,
+                test.Expected)
+        }
+    }
+}
+
+func TestCompoundSuffix(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    magic := map[string]string{
+        ".tgz": "\x1F\x8B",
+        ".tbz2": "BZh",
+        ".txz": "\xFD\x37\x7A\x58\x5A\x00",
+    }
+
+    for suffix, expected_magic := range magic {
+        file := path.Join(out_dir, "compound" + suffix)
+        out_fh, err := fileutil.CreateFile(file)
+        if err != nil {
+            t.Errorf("couldn't open output file %q: %s", file, err)
+            continue
+        }
+        fmt.Fprintf(out_fh, "%s", "compound\n")
+        if err = out_fh.Close(); err != nil {
+            t.Errorf("couldn't close output file %q: %s", file, err)
+            continue
+        }
+
+        data_bytes, err := ioutil.ReadFile(file)
+        if err != nil {
+            t.Errorf("couldn't read %q: %s", file, err)
+            continue
+        }
+        if !strings.HasPrefix(string(data_bytes), expected_magic) {
+            t.Errorf("%q not compressed: starts with %q", file,
+                data_bytes[:2])
+        }
+
+        in, err := fileutil.OpenFile(file)
+        if err != nil {
+            t.Errorf("couldn't open file %q for input: %s", file, err)
+            continue
+        }
+        data_bytes, err = ioutil.ReadAll(in)
+        in.Close()
+        if err != nil || string(data_bytes) != "compound\n" {
+            t.Errorf("got %q, %v from %q, expected %q", data_bytes, err,
+                file, "compound\n")
+        }
+    }
+}
+
+func TestSuffixCaseAndAliases(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    tests := []struct {
+        Name string
+        Suffix string
+        Format string
+    }{
+        {"gzip_upper", ".GZ", "gzip"},
+        {"gzip_mixed", ".Gz", "gzip"},
+        {"bzip2_upper", ".BZ2", "bzip2"},
+        {"zstd_alias", ".zstd", "zstd"},
+        {"zstd_upper", ".ZST", "zstd"},
+        {"zlib", ".zlib", "zlib"},
+        {"zlib_alias", ".z", "zlib"},
+        {"lzma", ".lzma", "lzma"},
+        {"tgz_upper", ".TGZ", "gzip"},
+    }
+
+    test_str := "case-insensitive\n"
+    for _, test := range tests {
+        t.Run(test.Name, func(st *testing.T) {
+            file := path.Join(out_dir, test.Name + test.Suffix)
+            out_fh, err := fileutil.CreateFile(file)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            fmt.Fprintf(out_fh, "%s", test_str)
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            raw, err := ioutil.ReadFile(file)
+            if err != nil {
+                st.Errorf("couldn't read %q: %s", file, err)
+                return
+            }
+            if string(raw) == test_str {
+                st.Errorf("%q was not compressed", file)
+            }
+
+            in, err := fileutil.OpenFile(file)
+            if err != nil {
+                st.Errorf("couldn't open file %q for input: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            format_fh, ok := in.(fileutil.FormatReadCloser)
+            if !ok {
+                st.Errorf("handle for %q doesn't report its format", file)
+            } else if format_fh.Format() != test.Format {
+                st.Errorf("got format %q, expected %q", format_fh.Format(),
+                    test.Format)
+            }
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err != nil {
+                st.Errorf("couldn't read all from file %q: %s", file, err)
+                return
+            }
+            if string(data_bytes) != test_str {
+                st.Errorf("file contents incorrect: got %q, expected %q",
+                    string(data_bytes), test_str)
+            }
+        })
+    }
+}
+
+func TestDecompressionLimits(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // A megabyte of zeros compresses to a tiny fraction of its size.
+    data := make([]byte, 1 << 20)
+
+    tests := []struct {
+        name string
+        suffix string
+        opts fileutil.OpenOptions
+        expected_len int
+        fail bool
+    }{
+        {"gzip size", "gz",
+            fileutil.OpenOptions{MaxDecompressedSize: 1000}, 1000, true},
+        {"bzip2 size", "bz2",
+            fileutil.OpenOptions{MaxDecompressedSize: 5000}, 5000, true},
+        {"xz size", "xz",
+            fileutil.OpenOptions{MaxDecompressedSize: 100}, 100, true},
+        {"zstd size", "zst",
+            fileutil.OpenOptions{MaxDecompressedSize: 1 << 19}, 1 << 19,
+            true},
+        {"gzip ratio", "gz",
+            fileutil.OpenOptions{MaxExpansionRatio: 50}, -1, true},
+        {"zstd ratio", "zst",
+            fileutil.OpenOptions{MaxExpansionRatio: 50}, -1, true},
+        {"within limits", "gz",
+            fileutil.OpenOptions{MaxDecompressedSize: 1 << 20,
+                MaxExpansionRatio: 10000}, 1 << 20, false},
+        {"no limits", "bz2", fileutil.OpenOptions{}, 1 << 20, false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(st *testing.T) {
+            file := path.Join(out_dir, "test_out." + test.suffix)
+            out_fh, err := fileutil.CreateFile(file)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            out_fh.Write(data)
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            in, err := fileutil.OpenFileWithOptions(file, test.opts)
+            if err != nil {
+                st.Errorf("couldn't open file %q for input: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            got, err := ioutil.ReadAll(in)
+            if !test.fail {
+                if err != nil {
+                    st.Errorf("couldn't read all from file %q: %s", file,
+                        err)
+                } else if len(got) != test.expected_len {
+                    st.Errorf("got %d bytes, expected %d", len(got),
+                        test.expected_len)
+                }
+                return
+            }
+
+            var limit_err *fileutil.DecompressionLimitError
+            if !errors.As(err, &limit_err) {
+                st.Errorf("got error %v, expected a DecompressionLimitError",
+                    err)
+                return
+            }
+            if !errors.Is(err, fileutil.Err_LimitExceeded) {
+                st.Errorf("error %v doesn't match Err_LimitExceeded", err)
+            }
+            if test.expected_len >= 0 && len(got) != test.expected_len {
+                st.Errorf("got %d bytes, expected %d", len(got),
+                    test.expected_len)
+            }
+            if len(got) >= len(data) {
+                st.Errorf("got all %d bytes despite the limit", len(got))
+            }
+        })
+    }
+
+    // The same limits apply to a decompression layer on a plain reader.
+    var buf bytes.Buffer
+    gz := gzip.NewWriter(&buf)
+    gz.Write(data)
+    gz.Close()
+
+    r, err := fileutil.AddDecompressionLayerWithOptions(&buf, "gz",
+        fileutil.OpenOptions{MaxDecompressedSize: 10})
+    if err != nil {
+        t.Errorf("couldn't add decompression layer: %s", err)
+        return
+    }
+    defer r.Close()
+    got, err := ioutil.ReadAll(r)
+    if !errors.Is(err, fileutil.Err_LimitExceeded) || len(got) != 10 {
+        t.Errorf("got %d bytes and error %v, expected 10 bytes and %v",
+            len(got), err, fileutil.Err_LimitExceeded)
+    }
+}
+
+func TestCompressSuffixNotZlib(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // The start of a compress(1) file, which zlib can't read.
+    raw := "\x1F\x9D\x90old data"
+    for _, name := range []string{"old.Z", "logs.taZ"} {
+        file := path.Join(out_dir, name)
+        if err = ioutil.WriteFile(file, []byte(raw), 0644); err != nil {
+            t.Errorf("couldn't write %q: %s", file, err)
+            return
+        }
+
+        got, err := read_file(file)
+        if err != nil {
+            t.Errorf("%s", err)
+            continue
+        }
+        if got != raw {
+            t.Errorf("%s: got contents %q, expected %q", name, got, raw)
+        }
+    }
+}
+
+func TestCompressionLevels(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    test_str := strings.Repeat("a", 1 << 16)
+    tests := []struct {
+        name string
+        suffix string
+        opts fileutil.Options
+        min_size int
+        max_size int
+        fail bool
+    }{
+        {"gzip default", ".gz", fileutil.Options{}, 0, 1000, false},
+        {"gzip none", ".gz", fileutil.Options{GzipLevelSet: true},
+            len(test_str), 1 << 17, false},
+        {"zlib none", ".zlib", fileutil.Options{GzipLevelSet: true},
+            len(test_str), 1 << 17, false},
+        {"gzip invalid", ".gz", fileutil.Options{GzipLevel: 12}, 0, 0,
+            true},
+        {"xz preset 0", ".xz", fileutil.Options{XzLevelSet: true}, 0, 1000,
+            false},
+        {"xz preset 9", ".xz", fileutil.Options{XzLevel: 9}, 0, 1000, false},
+        {"xz invalid", ".xz", fileutil.Options{XzLevel: 10}, 0, 0, true},
+        {"xz negative", ".xz",
+            fileutil.Options{XzLevel: -1, XzLevelSet: true}, 0, 0, true},
+        {"bzip2 level 1", ".bz2", fileutil.Options{Bzip2Level: 1}, 0, 1000,
+            false},
+        {"bzip2 invalid", ".bz2", fileutil.Options{Bzip2Level: 10}, 0, 0,
+            true},
+        {"bzip2 negative", ".bz2", fileutil.Options{Bzip2Level: -1}, 0, 0,
+            true},
+        {"bzip2 parallel invalid", ".bz2",
+            fileutil.Options{Bzip2Level: 10, Parallel: true}, 0, 0, true},
+        {"zstd level 1", ".zst", fileutil.Options{ZstdLevel: 1}, 0, 1000,
+            false},
+        {"zstd level 22", ".zst", fileutil.Options{ZstdLevel: 22}, 0, 1000,
+            false},
+        {"zstd invalid", ".zst", fileutil.Options{ZstdLevel: 23}, 0, 0,
+            true},
+        {"zstd negative", ".zst", fileutil.Options{ZstdLevel: -1}, 0, 0,
+            true},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(st *testing.T) {
+            file := path.Join(out_dir, "test_levels" + test.suffix)
+            out_fh, err := fileutil.CreateFileWithOptions(file, test.opts)
+            if test.fail {
+                if err == nil {
+                    out_fh.Close()
+                    st.Errorf("got no error for options %+v", test.opts)
+                }
+                return
+            }
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            fmt.Fprintf(out_fh, "%s", test_str)
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            info, err := os.Stat(file)
+            if err != nil {
+                st.Errorf("couldn't stat %q: %s", file, err)
+                return
+            }
+            if info.Size() < int64(test.min_size) ||
+                info.Size() > int64(test.max_size) {
+                st.Errorf("got %d bytes of output, expected %d to %d",
+                    info.Size(), test.min_size, test.max_size)
+            }
+
+            got, err := read_file(file)
+            if err != nil {
+                st.Errorf("%s", err)
+                return
+            }
+            if got != test_str {
+                st.Errorf("file contents incorrect: got %d bytes, " +
+                    "expected %d", len(got), len(test_str))
+            }
+        })
+    }
+}
+
+func TestXzNativeFallback(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Hide the xz program so that the pure-Go implementation is used.
+    defer os.Setenv("PATH", os.Getenv("PATH"))
+    os.Setenv("PATH", "")
+    fileutil.SetExecSearchDirs(nil)
+    defer fileutil.SetExecSearchDirs(
+        []string{"/bin", "/usr/bin", "/usr/local/bin"})
+
+    if found, err := fileutil.LookupExec("xz"); err == nil {
+        t.Errorf("found xz at %q with an empty search path", found)
+        return
+    }
+
+    test_str := strings.Repeat("native xz fallback test\n", 10000)
+    for _, level := range []int{0, 1, 9} {
+        t.Run(fmt.Sprintf("level %d", level), func(st *testing.T) {
+            file := path.Join(out_dir, fmt.Sprintf("native_%d.xz", level))
+            opts := fileutil.Options{XzLevel: level, XzLevelSet: true}
+            out_fh, err := fileutil.CreateFileWithOptions(file, opts)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            fmt.Fprintf(out_fh, "%s", test_str)
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            got, err := read_file(file)
+            if err != nil {
+                st.Errorf("%s", err)
+                return
+            }
+            if got != test_str {
+                st.Errorf("file contents incorrect: got %d bytes, " +
+                    "expected %d", len(got), len(test_str))
+            }
+        })
+    }
+}
+
+func TestBzip2NativeWriter(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Hide the bzip2 and pbzip2 programs, which shouldn't be needed.
+    defer os.Setenv("PATH", os.Getenv("PATH"))
+    os.Setenv("PATH", "")
+    fileutil.SetExecSearchDirs(nil)
+    defer fileutil.SetExecSearchDirs(
+        []string{"/bin", "/usr/bin", "/usr/local/bin"})
+
+    for _, name := range []string{"bzip2", "pbzip2"} {
+        if found, err := fileutil.LookupExec(name); err == nil {
+            t.Errorf("found %s at %q with an empty search path", name, found)
+            return
+        }
+    }
+
+    test_str := strings.Repeat("native bzip2 test\n", 10000)
+    tests := map[string]fileutil.Options{
+        "default": fileutil.Options{},
+        "level 1": fileutil.Options{Bzip2Level: 1},
+        "parallel": fileutil.Options{Parallel: true},
+    }
+    for name, opts := range tests {
+        t.Run(name, func(st *testing.T) {
+            file := path.Join(out_dir, "native_" +
+                strings.ReplaceAll(name, " ", "_") + ".bz2")
+            out_fh, err := fileutil.CreateFileWithOptions(file, opts)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+            fmt.Fprintf(out_fh, "%s", test_str)
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            got, err := read_file(file)
+            if err != nil {
+                st.Errorf("%s", err)
+                return
+            }
+            if got != test_str {
+                st.Errorf("file contents incorrect: got %d bytes, " +
+                    "expected %d", len(got), len(test_str))
+            }
+        })
+    }
+}
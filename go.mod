@@ -1,3 +1,9 @@
 module github.com/cuberat-go/fileutil
 
-go 1.14
+go 1.20
+
+require (
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.17.9
+	github.com/ulikunitz/xz v0.5.17
+)
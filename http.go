@@ -0,0 +1,324 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020 Don Owens <don@regexguy.com>.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+//   this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package fileutil
+
+import (
+    // Built-in/core modules.
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+)
+
+// Maps values of the Content-Encoding response header to codec names.
+var content_encodings = map[string]string{
+    "gzip": "gzip",
+    "x-gzip": "gzip",
+    "deflate": "zlib",
+    "bzip2": "bzip2",
+    "xz": "xz",
+    "zstd": "zstd",
+}
+
+// Reports whether name is an http:// or https:// URL.
+func is_url(name string) bool {
+    lower := strings.ToLower(name)
+    return strings.HasPrefix(lower, "http://") ||
+        strings.HasPrefix(lower, "https://")
+}
+
+// Returns the suffix of infile, ignoring any query string or fragment if it
+// is a URL.
+func input_suffix(infile string) string {
+    if is_url(infile) {
+        if u, err := url.Parse(infile); err == nil {
+            return file_suffix(u.Path)
+        }
+    }
+
+    return file_suffix(infile)
+}
+
+// Returns the codec for the Content-Encoding of a response, or nil if the
+// body isn't encoded.
+func content_encoding_codec(r *http_reader) (*codec, error) {
+    encoding := strings.ToLower(strings.TrimSpace(r.content_encoding))
+    if encoding == "" || encoding == "identity" {
+        return nil, nil
+    }
+
+    if name, ok := content_encodings[encoding]; ok {
+        if c := lookup_codec_by_name(name); c != nil {
+            return c, nil
+        }
+    }
+
+    return nil, fmt.Errorf("couldn't decode %s with Content-Encoding %q: %w",
+        r.url, encoding, Err_NotSupported)
+}
+
+// Reads the body of an HTTP GET response, resuming with Range requests if
+// the transfer fails and retries are left.
+type http_reader struct {
+    ctx context.Context
+    client *http.Client
+    url string
+    retries int
+    retry_delay time.Duration
+    body io.ReadCloser
+    offset int64
+    validator string
+    content_encoding string
+}
+
+func open_url(
+    ctx context.Context,
+    raw_url string,
+    opts *OpenOptions,
+) (*http_reader, error) {
+    r := &http_reader{
+        ctx: ctx,
+        client: opts.HTTPClient,
+        url: raw_url,
+        retries: opts.HTTPRetries,
+        retry_delay: opts.HTTPRetryDelay,
+    }
+    if r.client == nil {
+        r.client = http.DefaultClient
+    }
+
+    resp, err := r.get()
+    if err != nil {
+        return nil, err
+    }
+
+    r.body = resp.Body
+    r.content_encoding = resp.Header.Get("Content-Encoding")
+
+    // Resume only if the resource is unchanged. Weak ETags can't be used
+    // with If-Range.
+    if etag := resp.Header.Get("ETag"); etag != "" &&
+        !strings.HasPrefix(etag, "W/") {
+        r.validator = etag
+    } else {
+        r.validator = resp.Header.Get("Last-Modified")
+    }
+
+    return r, nil
+}
+
+// Sends a request for the data from the current offset, retrying transport
+// errors and server errors while retries are left.
+func (r *http_reader) get() (*http.Response, error) {
+    for {
+        resp, err := r.request()
+        if err == nil {
+            return resp, nil
+        }
+        if r.retries <= 0 || !retryable_http_error(err) ||
+            r.ctx.Err() != nil {
+            return nil, err
+        }
+        r.retries--
+
+        if r.retry_wait() != nil {
+            return nil, err
+        }
+    }
+}
+
+// Waits for the retry delay before a request is sent again. Returns the
+// context's error if it is done first.
+func (r *http_reader) retry_wait() error {
+    if r.retry_delay <= 0 {
+        return nil
+    }
+
+    select {
+    case <-time.After(r.retry_delay):
+        return nil
+    case <-r.ctx.Done():
+        return r.ctx.Err()
+    }
+}
+
+func (r *http_reader) request() (*http.Response, error) {
+    req, err := http.NewRequestWithContext(r.ctx, "GET", r.url, nil)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't create request for %s: %w", r.url,
+            err)
+    }
+
+    // Ask for the data as stored, so that offsets for resuming are the
+    // same from one request to the next. Setting this also stops
+    // net/http from decompressing gzip responses on its own.
+    req.Header.Set("Accept-Encoding", "identity")
+
+    if r.offset > 0 {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+        req.Header.Set("If-Range", r.validator)
+    }
+
+    resp, err := r.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+
+    if r.offset == 0 && resp.StatusCode == http.StatusOK {
+        return resp, nil
+    }
+    if r.offset > 0 && resp.StatusCode == http.StatusPartialContent {
+        content_range := resp.Header.Get("Content-Range")
+        if start, ok := content_range_start(content_range); ok &&
+            start == r.offset {
+            return resp, nil
+        }
+        resp.Body.Close()
+        return nil, fmt.Errorf(
+            "couldn't resume %s at byte %d: got Content-Range %q",
+            r.url, r.offset, content_range)
+    }
+    resp.Body.Close()
+
+    if r.offset > 0 && resp.StatusCode == http.StatusOK {
+        return nil, fmt.Errorf(
+            "couldn't resume %s at byte %d: server sent the whole resource: %w",
+            r.url, r.offset, Err_NotSupported)
+    }
+
+    return nil, &HTTPStatusError{URL: r.url, StatusCode: resp.StatusCode,
+        Status: resp.Status}
+}
+
+// Returns the first byte position in a Content-Range header such as
+// "bytes 100-199/200".
+func content_range_start(header string) (int64, bool) {
+    if !strings.HasPrefix(header, "bytes ") {
+        return 0, false
+    }
+
+    idx := strings.Index(header, "-")
+    if idx < 0 {
+        return 0, false
+    }
+
+    start, err := strconv.ParseInt(strings.TrimSpace(header[6:idx]), 10, 64)
+    if err != nil {
+        return 0, false
+    }
+
+    return start, true
+}
+
+// Reports whether a request that failed with err may succeed if sent again.
+func retryable_http_error(err error) bool {
+    var status_err *HTTPStatusError
+    if errors.As(err, &status_err) {
+        return status_err.StatusCode >= 500 ||
+            status_err.StatusCode == http.StatusTooManyRequests
+    }
+
+    return transient_error(err)
+}
+
+// Reports whether err is a timeout or a dropped connection, as opposed to a
+// failure that will happen again, such as a TLS or unsupported scheme error.
+func transient_error(err error) bool {
+    var net_err net.Error
+    if errors.As(err, &net_err) && net_err.Timeout() {
+        return true
+    }
+
+    var dns_err *net.DNSError
+    if errors.As(err, &dns_err) && dns_err.IsTemporary {
+        return true
+    }
+
+    return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+        errors.Is(err, syscall.ECONNRESET) ||
+        errors.Is(err, syscall.ECONNABORTED) ||
+        errors.Is(err, syscall.EPIPE)
+}
+
+func (r *http_reader) Name() string {
+    return r.url
+}
+
+func (r *http_reader) Read(p []byte) (int, error) {
+    for {
+        n, err := r.body.Read(p)
+        r.offset += int64(n)
+        if err == nil || err == io.EOF || r.retries <= 0 ||
+            r.ctx.Err() != nil || !transient_error(err) {
+            return n, err
+        }
+
+        // Without an ETag or Last-Modified header, there is no way to be
+        // sure the rest of the data belongs with what was already read.
+        if r.validator == "" {
+            return n, fmt.Errorf(
+                "couldn't read %s: %w; can't resume without a validator",
+                r.url, err)
+        }
+
+        // The transfer failed part way through. Pick up where it left off.
+        r.body.Close()
+        r.retries--
+        var resp *http.Response
+        resume_err := r.retry_wait()
+        if resume_err == nil {
+            resp, resume_err = r.get()
+        }
+        if resume_err != nil {
+            err = fmt.Errorf("couldn't read %s: %s; %w", r.url, err,
+                resume_err)
+            r.body = ReadCloserFromReader(&error_reader{err: err}, nil)
+            return n, err
+        }
+        r.body = resp.Body
+
+        if n > 0 {
+            return n, nil
+        }
+    }
+}
+
+func (r *http_reader) Close() error {
+    return r.body.Close()
+}
@@ -0,0 +1,450 @@
+package fileutil_test
+
+import (
+    // Built-in/core modules.
+    "bytes"
+    gzip "compress/gzip"
+    zlib "compress/zlib"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    ioutil "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+    fileutil "github.com/cuberat-go/fileutil"
+)
+
+func gzip_bytes(data string) []byte {
+    var buf bytes.Buffer
+    gz := gzip.NewWriter(&buf)
+    gz.Write([]byte(data))
+    gz.Close()
+
+    return buf.Bytes()
+}
+
+func TestOpenURL(t *testing.T) {
+    test_str := "id,value\n1,remote\n"
+    compressed := gzip_bytes(test_str)
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/data.csv.gz", func(w http.ResponseWriter,
+        r *http.Request) {
+        w.Write(compressed)
+    })
+    mux.HandleFunc("/plain.csv", func(w http.ResponseWriter,
+        r *http.Request) {
+        w.Write([]byte(test_str))
+    })
+    mux.HandleFunc("/encoded.csv", func(w http.ResponseWriter,
+        r *http.Request) {
+        w.Header().Set("Content-Encoding", "gzip")
+        w.Write(compressed)
+    })
+    // Some servers label .gz files with a gzip Content-Encoding.
+    mux.HandleFunc("/labelled.csv.gz", func(w http.ResponseWriter,
+        r *http.Request) {
+        w.Header().Set("Content-Encoding", "gzip")
+        w.Write(compressed)
+    })
+    mux.HandleFunc("/brotli.csv", func(w http.ResponseWriter,
+        r *http.Request) {
+        w.Header().Set("Content-Encoding", "br")
+        w.Write([]byte("not really brotli"))
+    })
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    tests := []struct {
+        name string
+        path string
+        format string
+        expected_err error
+    }{
+        {"suffix", "/data.csv.gz", "gzip", nil},
+        {"suffix with query", "/data.csv.gz?token=abc", "gzip", nil},
+        {"uncompressed", "/plain.csv", "", nil},
+        {"content encoding", "/encoded.csv", "gzip", nil},
+        {"encoding and suffix", "/labelled.csv.gz", "gzip", nil},
+        {"unsupported encoding", "/brotli.csv", "",
+            fileutil.Err_NotSupported},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(st *testing.T) {
+            file := server.URL + test.path
+            in, err := fileutil.OpenFile(file)
+            if test.expected_err != nil {
+                if !errors.Is(err, test.expected_err) {
+                    st.Errorf("got error %v, expected %v", err,
+                        test.expected_err)
+                }
+                if err == nil {
+                    in.Close()
+                }
+                return
+            }
+            if err != nil {
+                st.Errorf("couldn't open %q: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            if in.Name() != file {
+                st.Errorf("got name %q, expected %q", in.Name(), file)
+            }
+            format := ""
+            if f, ok := in.(fileutil.FormatReadCloser); ok {
+                format = f.Format()
+            }
+            if format != test.format {
+                st.Errorf("got format %q, expected %q", format, test.format)
+            }
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err != nil {
+                st.Errorf("couldn't read all from %q: %s", file, err)
+                return
+            }
+            if string(data_bytes) != test_str {
+                st.Errorf("got contents %q, expected %q",
+                    string(data_bytes), test_str)
+            }
+        })
+    }
+}
+
+// Registers a zlib codec with the suffixes given, in place of the built-in
+// one.
+func replace_zlib_codec(suffixes []string) error {
+    return fileutil.RegisterCodec(fileutil.Codec{
+        Name: "zlib",
+        Suffixes: suffixes,
+        NewReader: func(ctx context.Context,
+            r io.Reader) (io.ReadCloser, error) {
+            return zlib.NewReader(r)
+        },
+        NewWriter: func(ctx context.Context,
+            w io.Writer) (io.WriteCloser, error) {
+            return zlib.NewWriter(w), nil
+        },
+    })
+}
+
+func TestOpenURLEncodingByName(t *testing.T) {
+    // The Content-Encoding "deflate" maps to the codec named "zlib", which
+    // no longer has "zlib" as a suffix.
+    defer replace_zlib_codec([]string{"zlib", "z"})
+    if err := replace_zlib_codec([]string{"z"}); err != nil {
+        t.Errorf("couldn't register codec: %s", err)
+        return
+    }
+
+    test_str := "id,value\n1,deflated\n"
+    var buf bytes.Buffer
+    zw := zlib.NewWriter(&buf)
+    io.WriteString(zw, test_str)
+    zw.Close()
+
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Encoding", "deflate")
+        w.Write(buf.Bytes())
+    }
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    file := server.URL + "/encoded.csv"
+    in, err := fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open %q: %s", file, err)
+        return
+    }
+    defer in.Close()
+
+    data_bytes, err := ioutil.ReadAll(in)
+    if err != nil {
+        t.Errorf("couldn't read all from %q: %s", file, err)
+        return
+    }
+    if string(data_bytes) != test_str {
+        t.Errorf("got contents %q, expected %q", string(data_bytes),
+            test_str)
+    }
+}
+
+func TestOpenURLStatus(t *testing.T) {
+    var mu sync.Mutex
+    failures := 0
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/flaky.txt", func(w http.ResponseWriter,
+        r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        if failures > 0 {
+            failures--
+            http.Error(w, "try again", http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte("finally\n"))
+    })
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    file := server.URL + "/missing.txt.gz"
+    _, err := fileutil.OpenFile(file)
+    var status_err *fileutil.HTTPStatusError
+    if !errors.As(err, &status_err) {
+        t.Errorf("got error %v, expected an HTTPStatusError", err)
+        return
+    }
+    if status_err.StatusCode != http.StatusNotFound {
+        t.Errorf("got status code %d, expected %d", status_err.StatusCode,
+            http.StatusNotFound)
+    }
+    if !strings.Contains(err.Error(), file) {
+        t.Errorf("error %q doesn't mention %q", err, file)
+    }
+
+    file = server.URL + "/flaky.txt"
+    failures = 2
+    _, err = fileutil.OpenFileWithOptions(file,
+        fileutil.OpenOptions{HTTPRetries: 1})
+    if !errors.As(err, &status_err) ||
+        status_err.StatusCode != http.StatusServiceUnavailable {
+        t.Errorf("got error %v, expected status %d", err,
+            http.StatusServiceUnavailable)
+    }
+
+    failures = 2
+    in, err := fileutil.OpenFileWithOptions(file,
+        fileutil.OpenOptions{HTTPRetries: 2,
+            HTTPRetryDelay: time.Millisecond})
+    if err != nil {
+        t.Errorf("couldn't open %q with retries: %s", file, err)
+        return
+    }
+    defer in.Close()
+    data_bytes, err := ioutil.ReadAll(in)
+    if err != nil || string(data_bytes) != "finally\n" {
+        t.Errorf("got contents %q and error %v, expected %q",
+            string(data_bytes), err, "finally\n")
+    }
+}
+
+func TestOpenURLResume(t *testing.T) {
+    test_str := strings.Repeat("resumable line of text\n", 10000)
+    compressed := gzip_bytes(test_str)
+    mtime := time.Unix(1600000000, 0)
+
+    var mu sync.Mutex
+    var ranges []string
+    var times []time.Time
+    truncate := true
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/dump.txt.gz", func(w http.ResponseWriter,
+        r *http.Request) {
+        mu.Lock()
+        ranges = append(ranges, r.Header.Get("Range"))
+        times = append(times, time.Now())
+        cut := truncate
+        truncate = false
+        mu.Unlock()
+
+        w.Header().Set("ETag", `"dump-v1"`)
+        if cut {
+            // Promise the whole body, send half, and drop the connection.
+            w.Header().Set("Content-Length", fmt.Sprint(len(compressed)))
+            w.Write(compressed[:len(compressed) / 2])
+            w.(http.Flusher).Flush()
+            panic(http.ErrAbortHandler)
+        }
+        http.ServeContent(w, r, "dump.txt.gz", mtime,
+            bytes.NewReader(compressed))
+    })
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    file := server.URL + "/dump.txt.gz"
+    retry_delay := 200 * time.Millisecond
+    in, err := fileutil.OpenFileWithOptions(file,
+        fileutil.OpenOptions{HTTPRetries: 1, HTTPRetryDelay: retry_delay})
+    if err != nil {
+        t.Errorf("couldn't open %q: %s", file, err)
+        return
+    }
+    defer in.Close()
+
+    data_bytes, err := ioutil.ReadAll(in)
+    if err != nil {
+        t.Errorf("couldn't read all from %q: %s", file, err)
+        return
+    }
+    if string(data_bytes) != test_str {
+        t.Errorf("got %d bytes, expected %d", len(data_bytes),
+            len(test_str))
+    }
+
+    expected_range := fmt.Sprintf("bytes=%d-", len(compressed) / 2)
+    if len(ranges) != 2 || ranges[0] != "" || ranges[1] != expected_range {
+        t.Errorf("got Range headers %q, expected %q", ranges,
+            []string{"", expected_range})
+    } else if gap := times[1].Sub(times[0]); gap < retry_delay {
+        t.Errorf("resumed after %s, expected a delay of at least %s", gap,
+            retry_delay)
+    }
+
+    // Without retries, the dropped connection is an error.
+    truncate = true
+    in, err = fileutil.OpenFile(file)
+    if err != nil {
+        t.Errorf("couldn't open %q: %s", file, err)
+        return
+    }
+    defer in.Close()
+    if _, err = ioutil.ReadAll(in); err == nil {
+        t.Errorf("got no error reading a truncated response")
+    }
+}
+
+func TestOpenURLResumeRefused(t *testing.T) {
+    test_str := strings.Repeat("line that must not be spliced\n", 10000)
+    body := []byte(test_str)
+
+    tests := []struct {
+        name string
+        etag string
+        content_range string
+    }{
+        {"no validator", "", ""},
+        {"wrong content range", `"v1"`, "bytes 0-%d/%d"},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(st *testing.T) {
+            var requests int32
+            handler := func(w http.ResponseWriter, r *http.Request) {
+                n := atomic.AddInt32(&requests, 1)
+                if test.etag != "" {
+                    w.Header().Set("ETag", test.etag)
+                }
+                if n == 1 {
+                    w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+                    w.Write(body[:len(body) / 2])
+                    w.(http.Flusher).Flush()
+                    panic(http.ErrAbortHandler)
+                }
+
+                // Answer the Range request with the start of the data.
+                w.Header().Set("Content-Range", fmt.Sprintf(
+                    test.content_range, len(body) - 1, len(body)))
+                w.WriteHeader(http.StatusPartialContent)
+                w.Write(body)
+            }
+            server := httptest.NewServer(http.HandlerFunc(handler))
+            defer server.Close()
+
+            file := server.URL + "/data.txt"
+            in, err := fileutil.OpenFileWithOptions(file,
+                fileutil.OpenOptions{HTTPRetries: 2})
+            if err != nil {
+                st.Errorf("couldn't open %q: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err == nil {
+                st.Errorf("got no error, expected a refusal to resume")
+            }
+            if len(data_bytes) > len(body) / 2 {
+                st.Errorf("got %d bytes, expected at most %d", len(data_bytes),
+                    len(body) / 2)
+            }
+            got_requests := atomic.LoadInt32(&requests)
+            if test.etag == "" && got_requests != 1 {
+                st.Errorf("got %d requests, expected 1", got_requests)
+            }
+        })
+    }
+}
+
+type round_trip_func func(req *http.Request) (*http.Response, error)
+
+func (f round_trip_func) RoundTrip(req *http.Request) (*http.Response,
+    error) {
+    return f(req)
+}
+
+type timeout_error struct{}
+
+func (e timeout_error) Error() string {
+    return "i/o timeout"
+}
+
+func (e timeout_error) Timeout() bool {
+    return true
+}
+
+func (e timeout_error) Temporary() bool {
+    return true
+}
+
+func TestOpenURLRetryErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        err error
+        expected_calls int
+        fail bool
+    }{
+        {"timeout", timeout_error{}, 3, false},
+        {"connection reset", io.ErrUnexpectedEOF, 3, false},
+        {"permanent", errors.New("tls: handshake failure"), 1, true},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(st *testing.T) {
+            calls := 0
+            client := &http.Client{Transport: round_trip_func(
+                func(req *http.Request) (*http.Response, error) {
+                    calls++
+                    if calls < 3 {
+                        return nil, test.err
+                    }
+                    return &http.Response{
+                        StatusCode: http.StatusOK,
+                        Status: "200 OK",
+                        Header: http.Header{},
+                        Body: ioutil.NopCloser(strings.NewReader("ok\n")),
+                        Request: req,
+                    }, nil
+                })}
+
+            in, err := fileutil.OpenFileWithOptions("http://mirror/data.txt",
+                fileutil.OpenOptions{HTTPClient: client, HTTPRetries: 3})
+            if err == nil {
+                in.Close()
+            }
+            if test.fail != (err != nil) {
+                st.Errorf("got error %v, expected failure: %t", err,
+                    test.fail)
+            }
+            if calls != test.expected_calls {
+                st.Errorf("got %d calls, expected %d", calls,
+                    test.expected_calls)
+            }
+        })
+    }
+}
@@ -0,0 +1,258 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020 Don Owens <don@regexguy.com>.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+//   this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package fileutil
+
+import (
+    // Built-in/core modules.
+    "bytes"
+    flate "compress/flate"
+    gzip "compress/gzip"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "sync"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+)
+
+// Size of the deflate window. Each block is compressed using the preceding
+// data as its dictionary, as pigz does, so that splitting the input into
+// blocks costs little in compression ratio.
+const deflate_window_size = 32768
+
+// Default size of the blocks compressed in parallel.
+const default_gzip_block_size = 1 << 20
+
+// A gzip writer that splits its input into blocks and compresses them on
+// separate goroutines. The compressed blocks are written out in order as a
+// single, standard gzip member.
+type parallel_gzip_writer struct {
+    w io.Writer
+    level int
+    block_size int
+
+    buf []byte
+    dict []byte
+    crc uint32
+    size uint32
+
+    // Blocks in the order they must be written. Its capacity limits the
+    // number of blocks being compressed at once.
+    queue chan *gzip_block
+    writer_done chan struct{}
+
+    err_lock sync.Mutex
+    err error
+    closed bool
+}
+
+type gzip_block struct {
+    data []byte
+    dict []byte
+    final bool
+    out bytes.Buffer
+    err error
+    done chan struct{}
+}
+
+func new_parallel_gzip_writer(
+    w io.Writer,
+    level int,
+    block_size int,
+    concurrency int,
+) (io.WriteCloser, error) {
+    if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+        return nil, fmt.Errorf("invalid gzip compression level: %d", level)
+    }
+
+    if block_size <= 0 {
+        block_size = default_gzip_block_size
+    }
+
+    // Header for a gzip member with no name, comment, or modification time.
+    header := []byte{0x1F, 0x8B, 8, 0, 0, 0, 0, 0, 0, 255}
+    if _, err := w.Write(header); err != nil {
+        return nil, err
+    }
+
+    pw := &parallel_gzip_writer{
+        w: w,
+        level: level,
+        block_size: block_size,
+        buf: make([]byte, 0, block_size),
+        queue: make(chan *gzip_block, concurrency),
+        writer_done: make(chan struct{}),
+    }
+
+    go pw.write_blocks()
+
+    return pw, nil
+}
+
+func (pw *parallel_gzip_writer) Write(p []byte) (int, error) {
+    if pw.closed {
+        return 0, errors.New("write to closed gzip writer")
+    }
+    if err := pw.get_err(); err != nil {
+        return 0, err
+    }
+
+    n := len(p)
+    pw.crc = crc32.Update(pw.crc, crc32.IEEETable, p)
+    pw.size += uint32(n)
+
+    for len(p) > 0 {
+        take := pw.block_size - len(pw.buf)
+        if take > len(p) {
+            take = len(p)
+        }
+
+        pw.buf = append(pw.buf, p[:take]...)
+        p = p[take:]
+
+        if len(pw.buf) == pw.block_size {
+            pw.submit(false)
+        }
+    }
+
+    return n, nil
+}
+
+// Queues the current block for compression and starts a new one. Blocks if
+// the maximum number of blocks are already in progress.
+func (pw *parallel_gzip_writer) submit(final bool) {
+    b := &gzip_block{
+        data: pw.buf,
+        dict: pw.dict,
+        final: final,
+        done: make(chan struct{}),
+    }
+
+    // The block's data isn't modified after this point, so the next
+    // dictionary can refer to it directly.
+    if len(pw.buf) >= deflate_window_size {
+        pw.dict = pw.buf[len(pw.buf) - deflate_window_size:]
+    } else {
+        dict := append(append([]byte{}, pw.dict...), pw.buf...)
+        if len(dict) > deflate_window_size {
+            dict = dict[len(dict) - deflate_window_size:]
+        }
+        pw.dict = dict
+    }
+    pw.buf = make([]byte, 0, pw.block_size)
+
+    pw.queue <- b
+    go b.compress(pw.level)
+}
+
+func (b *gzip_block) compress(level int) {
+    defer close(b.done)
+
+    fw, err := flate.NewWriterDict(&b.out, level, b.dict)
+    if err != nil {
+        b.err = err
+        return
+    }
+
+    if _, err = fw.Write(b.data); err != nil {
+        b.err = err
+        return
+    }
+
+    // Only the last block is marked final. Flushing the others ends them on
+    // a byte boundary so that they can be concatenated.
+    if b.final {
+        b.err = fw.Close()
+    } else {
+        b.err = fw.Flush()
+    }
+}
+
+// Writes compressed blocks to the underlying writer in order.
+func (pw *parallel_gzip_writer) write_blocks() {
+    defer close(pw.writer_done)
+
+    for b := range pw.queue {
+        <-b.done
+
+        if pw.get_err() != nil {
+            continue
+        }
+        if b.err != nil {
+            pw.set_err(b.err)
+            continue
+        }
+        if _, err := pw.w.Write(b.out.Bytes()); err != nil {
+            pw.set_err(err)
+        }
+    }
+}
+
+func (pw *parallel_gzip_writer) get_err() error {
+    pw.err_lock.Lock()
+    defer pw.err_lock.Unlock()
+
+    return pw.err
+}
+
+func (pw *parallel_gzip_writer) set_err(err error) {
+    pw.err_lock.Lock()
+    defer pw.err_lock.Unlock()
+
+    if pw.err == nil {
+        pw.err = err
+    }
+}
+
+// Compresses any remaining data and writes the gzip trailer. Does not close
+// the underlying writer.
+func (pw *parallel_gzip_writer) Close() error {
+    if pw.closed {
+        return nil
+    }
+    pw.closed = true
+
+    pw.submit(true)
+    close(pw.queue)
+    <-pw.writer_done
+
+    if err := pw.get_err(); err != nil {
+        return err
+    }
+
+    trailer := make([]byte, 8)
+    binary.LittleEndian.PutUint32(trailer[:4], pw.crc)
+    binary.LittleEndian.PutUint32(trailer[4:], pw.size)
+    _, err := pw.w.Write(trailer)
+
+    return err
+}
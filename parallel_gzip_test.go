@@ -0,0 +1,114 @@
+package fileutil_test
+
+import (
+    // Built-in/core modules.
+    "bytes"
+    "fmt"
+    ioutil "io/ioutil"
+    "math/rand"
+    "os"
+    exec "os/exec"
+    "path"
+    "testing"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+    fileutil "github.com/cuberat-go/fileutil"
+)
+
+func TestParallelGzip(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Compressible but not trivially repetitive input.
+    words := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta"}
+    rnd := rand.New(rand.NewSource(1))
+    var input bytes.Buffer
+    for input.Len() < 1 << 20 {
+        fmt.Fprintf(&input, "%s %d\n", words[rnd.Intn(len(words))],
+            rnd.Intn(1000))
+    }
+
+    tests := []struct {
+        Name string
+        Data []byte
+        BlockSize int
+        Concurrency int
+    }{
+        {"small_blocks", input.Bytes(), 4096, 4},
+        {"default_blocks", input.Bytes(), 0, 2},
+        {"single_goroutine", input.Bytes(), 65536, 1},
+        {"partial_block", input.Bytes()[:1000], 4096, 4},
+        {"empty", []byte{}, 4096, 4},
+    }
+
+    for _, test := range tests {
+        t.Run(test.Name, func(st *testing.T) {
+            file := path.Join(out_dir, test.Name + ".gz")
+            opts := fileutil.Options{
+                GzipConcurrency: test.Concurrency,
+                GzipBlockSize: test.BlockSize,
+                GzipLevel: 6,
+            }
+
+            out_fh, err := fileutil.CreateFileWithOptions(file, opts)
+            if err != nil {
+                st.Errorf("couldn't open output file %q: %s", file, err)
+                return
+            }
+
+            // Write in odd-sized pieces to cross block boundaries.
+            data := test.Data
+            for len(data) > 0 {
+                n := 1000 + rnd.Intn(7000)
+                if n > len(data) {
+                    n = len(data)
+                }
+                if _, err = out_fh.Write(data[:n]); err != nil {
+                    st.Errorf("couldn't write to %q: %s", file, err)
+                    out_fh.Close()
+                    return
+                }
+                data = data[n:]
+            }
+
+            if err = out_fh.Close(); err != nil {
+                st.Errorf("couldn't close output file %q: %s", file, err)
+                return
+            }
+
+            in, err := fileutil.OpenFile(file)
+            if err != nil {
+                st.Errorf("couldn't open file %q for input: %s", file, err)
+                return
+            }
+            defer in.Close()
+
+            data_bytes, err := ioutil.ReadAll(in)
+            if err != nil {
+                st.Errorf("couldn't read all from file %q: %s", file, err)
+                return
+            }
+            if !bytes.Equal(data_bytes, test.Data) {
+                st.Errorf("file contents incorrect for %q: got %d bytes, " +
+                    "expected %d", file, len(data_bytes), len(test.Data))
+            }
+
+            // Check the stream with the gzip program as well, if present.
+            if gzip_path, err := exec.LookPath("gzip"); err == nil {
+                out, err := exec.Command(gzip_path, "-t", file).
+                    CombinedOutput()
+                if err != nil {
+                    st.Errorf("gzip -t failed for %q: %s: %s", file, err,
+                        out)
+                }
+            }
+        })
+    }
+}
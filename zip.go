@@ -0,0 +1,272 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020 Don Owens <don@regexguy.com>.  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice,
+//   this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package fileutil
+
+import (
+    // Built-in/core modules.
+    tar "archive/tar"
+    zip "archive/zip"
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+
+    // Third-party modules.
+
+
+    // First-party modules.
+)
+
+// Compression methods for zip entries, for use with `SetZipMethod()`.
+const (
+    // No compression.
+    ZipStore uint16 = zip.Store
+
+    // Deflate compression, the default.
+    ZipDeflate uint16 = zip.Deflate
+
+    // Zstandard compression, using the codec registered as "zstd". Not all
+    // zip tools can read it.
+    ZipZstd uint16 = 93
+)
+
+// Sets the compression method for zip entries added after the call, e.g.,
+// `ZipStore`. Entries from `CreateEntry()` keep the method in effect when
+// they were created, whenever they are closed. Directories are always
+// stored. Returns an error wrapping Err_NotSupported if the archive isn't a
+// zip archive, the method is unknown, or it is `ZipZstd` and the "zstd"
+// codec can't compress.
+func (a *ArchiveWriter) SetZipMethod(method uint16) error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    zf, ok := a.format.(*zip_format)
+    if !ok {
+        return fmt.Errorf("couldn't set zip method for %s: %w", a.name,
+            Err_NotSupported)
+    }
+
+    switch method {
+    case ZipStore, ZipDeflate:
+    case ZipZstd:
+        if !zf.zstd {
+            return fmt.Errorf("couldn't set zip method to zstd: %w",
+                Err_NotSupported)
+        }
+    default:
+        return fmt.Errorf("couldn't set zip method to %d: %w", method,
+            Err_NotSupported)
+    }
+    a.zip_method = method
+
+    return nil
+}
+
+// Reports whether the file name has a ".zip" format suffix.
+func is_zip_path(name string) bool {
+    return strings.EqualFold(ParsePath(name).Format, "zip")
+}
+
+func open_zip_archive(
+    archive string,
+    opts ArchiveOptions,
+) (*ArchiveReader, error) {
+    if is_std_stream(archive) || ParsePath(archive).Compression != "" {
+        return nil, fmt.Errorf("couldn't open zip archive %s: %w", archive,
+            Err_NotSupported)
+    }
+
+    zr, err := zip.OpenReader(archive)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't open zip archive %s: %w", archive,
+            err)
+    }
+
+    if c := lookup_codec_by_name("zstd"); c != nil && c.new_reader != nil {
+        zr.RegisterDecompressor(ZipZstd, func(r io.Reader) io.ReadCloser {
+            rc, err := c.new_reader(context.Background(), r)
+            if err != nil {
+                return io.NopCloser(&error_reader{err: err})
+            }
+            return rc
+        })
+    }
+
+    a := &ArchiveReader{name: archive, opts: opts, close_func: zr.Close}
+    idx := 0
+
+    a.next_func = func() (*archive_entry, error) {
+        if idx >= len(zr.File) {
+            return nil, io.EOF
+        }
+        f := zr.File[idx]
+        idx++
+
+        entry := &archive_entry{
+            name: archive_entry_name(a.name, f.Name),
+            path: f.Name,
+            info: f.FileInfo(),
+        }
+
+        // Zip archives store the target of a symbolic link as its contents.
+        // If it can't be read, the entry has no target, and the error is
+        // returned by `Read()`.
+        if entry.info.Mode() & os.ModeSymlink != 0 {
+            target, err := read_zip_link(f)
+            if err != nil {
+                entry.set_reader(&error_reader{err: fmt.Errorf(
+                    "couldn't read link target of %s: %w", entry.name, err)},
+                    nil, &a.opts)
+                return entry, nil
+            }
+            entry.link_target = target
+            entry.set_reader(strings.NewReader(""), nil, &a.opts)
+            return entry, nil
+        }
+
+        zf := &zip_file_reader{name: entry.name, f: f}
+        entry.set_reader(zf, zf.Close, &a.opts)
+
+        return entry, nil
+    }
+
+    return a, nil
+}
+
+// Longest symbolic link target read from a zip archive, roughly PATH_MAX.
+const max_zip_link_size = 4096
+
+// Reads the target of a symbolic link stored in a zip archive. Targets
+// longer than max_zip_link_size give an error wrapping Err_LimitExceeded,
+// so that a crafted archive can't exhaust memory.
+func read_zip_link(f *zip.File) (string, error) {
+    rc, err := f.Open()
+    if err != nil {
+        return "", err
+    }
+    defer rc.Close()
+
+    target, err := io.ReadAll(io.LimitReader(rc, max_zip_link_size + 1))
+    if err != nil {
+        return "", err
+    }
+    if len(target) > max_zip_link_size {
+        return "", fmt.Errorf("target longer than %d bytes: %w",
+            max_zip_link_size, Err_LimitExceeded)
+    }
+
+    return string(target), nil
+}
+
+// A zip member that is opened when first read from, so that a member using
+// an unsupported compression method or encryption gives an error from
+// `Read()` instead of stopping iteration over the rest of the archive.
+type zip_file_reader struct {
+    name string
+    f *zip.File
+    rc io.ReadCloser
+    err error
+}
+
+func (z *zip_file_reader) Read(p []byte) (int, error) {
+    if z.rc == nil && z.err == nil {
+        rc, err := z.f.Open()
+        if err != nil {
+            z.err = fmt.Errorf("couldn't open %s: %w", z.name, err)
+        } else {
+            z.rc = rc
+        }
+    }
+    if z.err != nil {
+        return 0, z.err
+    }
+
+    return z.rc.Read(p)
+}
+
+func (z *zip_file_reader) Close() error {
+    if z.rc == nil {
+        return nil
+    }
+
+    return z.rc.Close()
+}
+
+type zip_format struct {
+    zw *zip.Writer
+
+    // Whether entries can be compressed with `ZipZstd`.
+    zstd bool
+}
+
+func new_zip_format(w io.Writer) *zip_format {
+    f := &zip_format{zw: zip.NewWriter(w)}
+    if c := lookup_codec_by_name("zstd"); c != nil && c.new_writer != nil {
+        f.zw.RegisterCompressor(ZipZstd,
+            func(w io.Writer) (io.WriteCloser, error) {
+                return c.new_writer(context.Background(), w, &Options{})
+            })
+        f.zstd = true
+    }
+
+    return f
+}
+
+func (f *zip_format) begin_entry(
+    hdr *tar.Header,
+    zip_method uint16,
+) (io.Writer, error) {
+    zh, err := zip.FileInfoHeader(hdr.FileInfo())
+    if err != nil {
+        return nil, err
+    }
+    zh.Name = hdr.Name
+    zh.Method = zip_method
+    if strings.HasSuffix(zh.Name, "/") {
+        zh.Method = ZipStore
+    }
+
+    return f.zw.CreateHeader(zh)
+}
+
+func (f *zip_format) end_entry() error {
+    return f.zw.Flush()
+}
+
+func (f *zip_format) close() error {
+    return f.zw.Close()
+}
+
+// Returns err from every call to `Read()`.
+type error_reader struct {
+    err error
+}
+
+func (r *error_reader) Read(p []byte) (int, error) {
+    return 0, r.err
+}
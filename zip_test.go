@@ -0,0 +1,501 @@
+package fileutil_test
+
+import (
+    // Built-in/core modules.
+    zip "archive/zip"
+    "bytes"
+    gzip "compress/gzip"
+    "context"
+    "errors"
+    "io"
+    ioutil "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "testing"
+    "time"
+
+    // Third-party modules.
+    zstd "github.com/klauspost/compress/zstd"
+
+    // First-party modules.
+    fileutil "github.com/cuberat-go/fileutil"
+)
+
+func TestZipArchive(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    nested_str := "nested and compressed\n"
+    var nested bytes.Buffer
+    gz := gzip.NewWriter(&nested)
+    gz.Write([]byte(nested_str))
+    gz.Close()
+
+    mtime := time.Unix(1600000000, 0)
+    tests := []struct {
+        path string
+        method uint16
+        data []byte
+        expected string
+        format string
+    }{
+        {"bundle/deflated.txt", fileutil.ZipDeflate,
+            []byte("deflated\n"), "deflated\n", ""},
+        {"bundle/stored.txt", fileutil.ZipStore, []byte("stored\n"),
+            "stored\n", ""},
+        {"bundle/zstd.txt", fileutil.ZipZstd, []byte("zstandard\n"),
+            "zstandard\n", ""},
+        {"bundle/nested.txt.gz", fileutil.ZipStore, nested.Bytes(),
+            nested_str, "gzip"},
+    }
+
+    file := path.Join(out_dir, "test_bundle.zip")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+    for _, test := range tests {
+        if err = archive.SetZipMethod(test.method); err != nil {
+            t.Errorf("couldn't set zip method %d: %s", test.method, err)
+            return
+        }
+        w, err := archive.CreateEntry(test.path, 0640, mtime)
+        if err != nil {
+            t.Errorf("couldn't create entry %q: %s", test.path, err)
+            return
+        }
+        w.Write(test.data)
+        if err = w.Close(); err != nil {
+            t.Errorf("couldn't close entry %q: %s", w.Name(), err)
+            return
+        }
+    }
+    err = archive.SetZipMethod(42)
+    if !errors.Is(err, fileutil.Err_NotSupported) {
+        t.Errorf("got error %v for unknown zip method, expected %v", err,
+            fileutil.Err_NotSupported)
+    }
+    if err = archive.Close(); err != nil {
+        t.Errorf("couldn't close archive %q: %s", file, err)
+        return
+    }
+
+    // Check the methods with the standard library's reader.
+    zr, err := zip.OpenReader(file)
+    if err != nil {
+        t.Errorf("couldn't open %q with archive/zip: %s", file, err)
+        return
+    }
+    for i, f := range zr.File {
+        if f.Method != tests[i].method {
+            t.Errorf("%s: got method %d, expected %d", f.Name, f.Method,
+                tests[i].method)
+        }
+    }
+    zr.Close()
+
+    reader, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer reader.Close()
+
+    for _, test := range tests {
+        entry, err := reader.Next()
+        if err != nil {
+            t.Errorf("couldn't read entry %q: %s", test.path, err)
+            return
+        }
+        name := file + "!/" + test.path
+        if entry.Name() != name {
+            t.Errorf("got name %q, expected %q", entry.Name(), name)
+        }
+        if entry.Format() != test.format {
+            t.Errorf("%s: got format %q, expected %q", entry.Name(),
+                entry.Format(), test.format)
+        }
+        if entry.FileInfo().Mode().Perm() != 0640 {
+            t.Errorf("%s: got mode %s, expected %s", entry.Name(),
+                entry.FileInfo().Mode().Perm(), os.FileMode(0640))
+        }
+        if !entry.FileInfo().ModTime().Equal(mtime) {
+            t.Errorf("%s: got mtime %s, expected %s", entry.Name(),
+                entry.FileInfo().ModTime(), mtime)
+        }
+        data_bytes, err := ioutil.ReadAll(entry)
+        if err != nil {
+            t.Errorf("couldn't read entry %q: %s", entry.Name(), err)
+            return
+        }
+        if string(data_bytes) != test.expected {
+            t.Errorf("%s: got contents %q, expected %q", entry.Name(),
+                string(data_bytes), test.expected)
+        }
+    }
+
+    if _, err = reader.Next(); err != io.EOF {
+        t.Errorf("got error %v at end of archive, expected io.EOF", err)
+    }
+}
+
+func TestZipMethodOnTar(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "test_archive.tar")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+    defer archive.Close()
+
+    err = archive.SetZipMethod(fileutil.ZipStore)
+    if !errors.Is(err, fileutil.Err_NotSupported) {
+        t.Errorf("got error %v, expected %v", err, fileutil.Err_NotSupported)
+    }
+}
+
+func TestZipMethodAtCreate(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "test_bundle.zip")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+
+    // Both entries are closed after the method changes.
+    archive.SetZipMethod(fileutil.ZipStore)
+    stored, err := archive.CreateEntry("stored.txt", 0644, time.Time{})
+    if err != nil {
+        t.Errorf("couldn't create entry: %s", err)
+        return
+    }
+    archive.SetZipMethod(fileutil.ZipDeflate)
+    deflated, err := archive.CreateEntry("deflated.txt", 0644, time.Time{})
+    if err != nil {
+        t.Errorf("couldn't create entry: %s", err)
+        return
+    }
+    archive.SetZipMethod(fileutil.ZipStore)
+    io.WriteString(stored, "stored\n")
+    io.WriteString(deflated, "deflated\n")
+    stored.Close()
+    deflated.Close()
+    if err = archive.Close(); err != nil {
+        t.Errorf("couldn't close archive %q: %s", file, err)
+        return
+    }
+
+    zr, err := zip.OpenReader(file)
+    if err != nil {
+        t.Errorf("couldn't open %q with archive/zip: %s", file, err)
+        return
+    }
+    defer zr.Close()
+
+    expected := map[string]uint16{
+        "stored.txt": fileutil.ZipStore,
+        "deflated.txt": fileutil.ZipDeflate,
+    }
+    for _, f := range zr.File {
+        if f.Method != expected[f.Name] {
+            t.Errorf("%s: got method %d, expected %d", f.Name, f.Method,
+                expected[f.Name])
+        }
+    }
+}
+
+func TestCreateCompressedZip(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "test_bundle.zip.gz")
+    archive, err := fileutil.CreateArchive(file)
+    if err == nil {
+        archive.Close()
+    }
+    if !errors.Is(err, fileutil.Err_NotSupported) {
+        t.Errorf("got error %v, expected %v", err, fileutil.Err_NotSupported)
+    }
+    if _, err = os.Stat(file); err == nil {
+        t.Errorf("%q was created", file)
+    }
+}
+
+type zip_raw_member struct {
+    name string
+    method uint16
+    mode os.FileMode
+    data string
+}
+
+// Writes members to a zip archive without compressing their data, so that
+// any method can be used.
+func write_zip_raw(file string, members []zip_raw_member) error {
+    out_fh, err := os.Create(file)
+    if err != nil {
+        return err
+    }
+    defer out_fh.Close()
+
+    zw := zip.NewWriter(out_fh)
+    for _, m := range members {
+        hdr := &zip.FileHeader{
+            Name: m.name,
+            Method: m.method,
+            CompressedSize64: uint64(len(m.data)),
+            UncompressedSize64: uint64(len(m.data)),
+        }
+        hdr.SetMode(m.mode)
+        w, err := zw.CreateRaw(hdr)
+        if err != nil {
+            return err
+        }
+        if _, err = io.WriteString(w, m.data); err != nil {
+            return err
+        }
+    }
+
+    return zw.Close()
+}
+
+func TestZipUnsupportedMethod(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // Method 14 is LZMA, which archive/zip doesn't support.
+    file := path.Join(out_dir, "test_methods.zip")
+    err = write_zip_raw(file, []zip_raw_member{
+        {"lzma.bin", 14, 0644, "not really lzma"},
+        {"lzma_link", 14, os.ModeSymlink | 0777, "lzma.bin"},
+        {"ok.txt", fileutil.ZipStore, 0644, "ok\n"},
+    })
+    if err != nil {
+        t.Errorf("couldn't write %q: %s", file, err)
+        return
+    }
+
+    reader, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer reader.Close()
+
+    for _, name := range []string{"lzma.bin", "lzma_link"} {
+        entry, err := reader.Next()
+        if err != nil {
+            t.Errorf("couldn't get entry %q: %s", name, err)
+            return
+        }
+        if entry.Path() != name {
+            t.Errorf("got path %q, expected %q", entry.Path(), name)
+        }
+        if _, err = ioutil.ReadAll(entry); err == nil {
+            t.Errorf("%s: got no error reading unsupported method", name)
+        }
+    }
+
+    entry, err := reader.Next()
+    if err != nil {
+        t.Errorf("couldn't get entry after unsupported members: %s", err)
+        return
+    }
+    data_bytes, err := ioutil.ReadAll(entry)
+    if err != nil || string(data_bytes) != "ok\n" {
+        t.Errorf("%s: got contents %q and error %v, expected %q",
+            entry.Name(), string(data_bytes), err, "ok\n")
+    }
+}
+
+func TestZipLongLink(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    file := path.Join(out_dir, "test_long_link.zip")
+    err = write_zip_raw(file, []zip_raw_member{
+        {"long_link", fileutil.ZipStore, os.ModeSymlink | 0777,
+            strings.Repeat("a/", 4000)},
+        {"ok.txt", fileutil.ZipStore, 0644, "ok\n"},
+    })
+    if err != nil {
+        t.Errorf("couldn't write %q: %s", file, err)
+        return
+    }
+
+    reader, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer reader.Close()
+
+    entry, err := reader.Next()
+    if err != nil {
+        t.Errorf("couldn't get entry %q: %s", "long_link", err)
+        return
+    }
+    if entry.LinkTarget() != "" {
+        t.Errorf("got link target of %d bytes, expected none",
+            len(entry.LinkTarget()))
+    }
+    if _, err = ioutil.ReadAll(entry); !errors.Is(err,
+        fileutil.Err_LimitExceeded) {
+        t.Errorf("got error %v, expected %v", err, fileutil.Err_LimitExceeded)
+    }
+
+    if entry, err = reader.Next(); err != nil || entry.Path() != "ok.txt" {
+        t.Errorf("got entry %v and error %v, expected ok.txt", entry, err)
+    }
+
+    dest_dir := path.Join(out_dir, "extracted")
+    err = fileutil.ExtractArchive(file, dest_dir, fileutil.ExtractOptions{})
+    if !errors.Is(err, fileutil.Err_LimitExceeded) {
+        t.Errorf("got error %v extracting, expected %v", err,
+            fileutil.Err_LimitExceeded)
+    }
+}
+
+// Registers a codec named "zstd" in place of the built-in one, with only the
+// constructors given.
+func replace_zstd_codec(
+    new_reader fileutil.NewReaderFunc,
+    new_writer fileutil.NewWriterFunc,
+) error {
+    return fileutil.RegisterCodec(fileutil.Codec{
+        Name: "zstd",
+        Suffixes: []string{"zst", "zstd"},
+        Magic: []byte{0x28, 0xB5, 0x2F, 0xFD},
+        NewReader: new_reader,
+        NewWriter: new_writer,
+    })
+}
+
+// Registers a zstd codec that can both read and write. It doesn't support
+// `ZstdLevel`, unlike the built-in one.
+func restore_zstd_codec() {
+    replace_zstd_codec(new_zstd_reader, new_zstd_writer)
+}
+
+func new_zstd_reader(
+    ctx context.Context,
+    r io.Reader,
+) (io.ReadCloser, error) {
+    decoder, err := zstd.NewReader(r)
+    if err != nil {
+        return nil, err
+    }
+
+    return decoder.IOReadCloser(), nil
+}
+
+func new_zstd_writer(
+    ctx context.Context,
+    w io.Writer,
+) (io.WriteCloser, error) {
+    return zstd.NewWriter(w)
+}
+
+func TestZipZstdMissingConstructor(t *testing.T) {
+    out_dir, err := ioutil.TempDir("", "fileutil_test_*")
+    if err != nil {
+        t.Errorf("couldn't create temp directory for testing: %s", err)
+        return
+    }
+    defer os.RemoveAll(out_dir)
+
+    // A zstd codec that can't write can't be used for zip entries.
+    defer restore_zstd_codec()
+    if err = replace_zstd_codec(new_zstd_reader, nil); err != nil {
+        t.Errorf("couldn't register codec: %s", err)
+        return
+    }
+
+    file := path.Join(out_dir, "test_bundle.zip")
+    archive, err := fileutil.CreateArchive(file)
+    if err != nil {
+        t.Errorf("couldn't create archive %q: %s", file, err)
+        return
+    }
+    err = archive.SetZipMethod(fileutil.ZipZstd)
+    if !errors.Is(err, fileutil.Err_NotSupported) {
+        t.Errorf("got error %v, expected %v", err, fileutil.Err_NotSupported)
+    }
+
+    entry, err := archive.CreateEntry("data.txt", 0644, time.Time{})
+    if err != nil {
+        t.Errorf("couldn't create entry: %s", err)
+        archive.Close()
+        return
+    }
+    io.WriteString(entry, "data\n")
+    if err = entry.Close(); err != nil {
+        t.Errorf("couldn't close entry: %s", err)
+    }
+    if err = archive.Close(); err != nil {
+        t.Errorf("couldn't close archive %q: %s", file, err)
+        return
+    }
+
+    // A zstd codec that can't read gives an error reading zstd members.
+    if err = replace_zstd_codec(nil, new_zstd_writer); err != nil {
+        t.Errorf("couldn't register codec: %s", err)
+        return
+    }
+
+    file = path.Join(out_dir, "test_zstd.zip")
+    err = write_zip_raw(file, []zip_raw_member{
+        {"zstd.bin", fileutil.ZipZstd, 0644, "not really zstd"},
+    })
+    if err != nil {
+        t.Errorf("couldn't write %q: %s", file, err)
+        return
+    }
+
+    reader, err := fileutil.OpenArchive(file)
+    if err != nil {
+        t.Errorf("couldn't open archive %q: %s", file, err)
+        return
+    }
+    defer reader.Close()
+
+    zstd_entry, err := reader.Next()
+    if err != nil {
+        t.Errorf("couldn't get entry: %s", err)
+        return
+    }
+    if _, err = ioutil.ReadAll(zstd_entry); err == nil {
+        t.Errorf("got no error reading zstd without a reader")
+    }
+}